@@ -1 +1,32 @@
 package main
+
+import (
+	"time"
+)
+
+// An Event is raised by any of the monitors when something noteworthy
+// starts or stops happening, e.g a threshold in a log was crossed.
+// Events are collected by the main thread and added to the results.
+type Event struct {
+	Source    string // Where the event came from, e.g the log path
+	Name      string // What the event is about, e.g the condition
+	Message   string
+	Firing    bool // True when the problem starts, false when it recovers or for one-off events
+	TimeStamp time.Time
+}
+
+// All events pass through this channel to the main thread
+var events = make(chan Event, 100)
+
+// Sends an event to the main thread. We do not block the monitor if the
+// main thread is busy, the event is then only written to our own log.
+func RaiseEvent(source string, name string, message string, firing bool) {
+
+	event := Event{source, name, message, firing, time.Now()}
+
+	select {
+	case events <- event:
+	default:
+		lLog.Print("Event queue full, event not sent: " + source + " " + name + " " + message)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sshd and sudo messages we understand in auth.log
+var authFailedRegex = regexp.MustCompile(`Failed (?:password|publickey|keyboard-interactive/pam|none) for (invalid user )?(\S+) from (\S+) port`)
+var authInvalidUserRegex = regexp.MustCompile(`Invalid user (\S*) from (\S+)`)
+var authAcceptedRegex = regexp.MustCompile(`Accepted (\S+) for (\S+) from (\S+) port`)
+var authSudoCommandRegex = regexp.MustCompile(`^\s*(\S+) : .*COMMAND=(.*)$`)
+var authSudoFailedRegex = regexp.MustCompile(`^\s*(\S+) : (?:\d+ )?incorrect password attempts?`)
+
+// How many of the ips and users with the most failed logins we report
+const topAuthFailureCount = 10
+
+// A login ip of a user we did not see for this long is new again
+const knownLoginMaxAge = 90 * 24 * time.Hour
+
+// All ips and users with failed logins per log, with their count
+var failedLoginsByIP = make(map[string]map[string]int64)
+var failedLoginsByUser = make(map[string]map[string]int64)
+var failedLoginsMutex = &sync.Mutex{}
+
+// Watches the sshd and sudo events in an auth log, for logs with
+// 'auth-monitor: true'. Failed logins are counted per source ip and per
+// user, and an event is raised when either goes over the limit within the
+// window. Successful logins from an ip we never saw for that user also
+// raise an event, which is not firing since there is nothing to recover.
+type authMonitor struct {
+	logPath        string
+	started        time.Time
+	window         time.Duration
+	maxFailures    int
+	failuresByIP   map[string][]time.Time
+	failuresByUser map[string][]time.Time
+	bruteForce     map[string]bool // The ips and users that are over the limit right now
+}
+
+// The users and the ips they logged in from are in these settings. They are
+// shared by all auth logs and persisted in the data file, so a restart does
+// not make every ip new.
+var knownLogins *Settings
+
+// Must be called before the auth logs are monitored
+func StartAuthMonitoring(settings *Settings) {
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+
+	if settings.KnownLoginIPs == nil {
+		settings.KnownLoginIPs = make(map[string]time.Time)
+	}
+	knownLogins = settings
+
+	pruneKnownLogins(time.Now())
+}
+
+func newAuthMonitor(logFile LogFile) *authMonitor {
+
+	if !logFile.AuthMonitor {
+		return nil
+	}
+
+	monitor := &authMonitor{}
+	monitor.logPath = logFile.Filepath
+	monitor.started = time.Now().Truncate(time.Second)
+	monitor.maxFailures = logFile.AuthMaxFailures
+	monitor.failuresByIP = make(map[string][]time.Time)
+	monitor.failuresByUser = make(map[string][]time.Time)
+	monitor.bruteForce = make(map[string]bool)
+
+	window, err := time.ParseDuration(logFile.AuthWindow)
+	if err != nil || window <= 0 {
+		window = 10 * time.Minute
+	}
+	monitor.window = window
+
+	if monitor.maxFailures <= 0 {
+		monitor.maxFailures = 10
+	}
+
+	return monitor
+}
+
+// Looks at the message of a parsed auth log line. If it is an event we
+// understand, the event, user and ip are added to the values, so they can
+// be used in the conditions, e.g 'auth_event == "failed_password"'. The
+// failed logins count at the time of their line, so the old lines read when
+// lorona starts do not look like an attack.
+func (monitor *authMonitor) handle(values map[string]interface{}, lineTime time.Time) {
+
+	if monitor == nil {
+		return
+	}
+
+	program := strings.ToLower(vtoa(values["program"]))
+	message := vtoa(values["description"])
+
+	var event, user, ip string
+
+	// sshd logs 'Invalid user' and then 'Failed password for invalid user'
+	// for the same attempt, only the first one counts as a failed login
+	failedLogin := false
+
+	if strings.HasPrefix(program, "sshd") {
+		if match := authFailedRegex.FindStringSubmatch(message); match != nil {
+			event, user, ip = "failed_password", match[2], match[3]
+			failedLogin = len(match[1]) == 0
+		} else if match := authInvalidUserRegex.FindStringSubmatch(message); match != nil {
+			event, user, ip = "invalid_user", match[1], match[2]
+			failedLogin = true
+		} else if match := authAcceptedRegex.FindStringSubmatch(message); match != nil {
+			event, user, ip = "accepted_"+match[1], match[2], match[3]
+		}
+	} else if program == "sudo" {
+		if match := authSudoFailedRegex.FindStringSubmatch(message); match != nil {
+			event, user = "sudo_failed", match[1]
+		} else if match := authSudoCommandRegex.FindStringSubmatch(message); match != nil {
+			event, user = "sudo_command", match[1]
+			values["auth_command"] = strings.TrimSpace(match[2])
+		}
+	}
+
+	if len(event) == 0 {
+		return
+	}
+
+	values["auth_event"] = event
+	values["auth_user"] = user
+	if len(ip) > 0 {
+		values["auth_ip"] = ip
+	}
+
+	countAuthEvent(monitor.logPath, event, user, ip, failedLogin)
+
+	now := time.Now()
+
+	if failedLogin && !lineTime.Before(now.Add(-monitor.window)) {
+		monitor.failuresByIP[ip] = append(monitor.failuresByIP[ip], lineTime)
+		monitor.failuresByUser[user] = append(monitor.failuresByUser[user], lineTime)
+	}
+
+	if strings.HasPrefix(event, "accepted_") {
+		monitor.checkNewLoginIP(user, ip, lineTime)
+	}
+
+	monitor.checkBruteForce(now)
+}
+
+// Raises an event when a user logs in from an ip we did not see before.
+// The logins of the lines read when lorona starts are remembered, but
+// they are old news and raise nothing.
+func (monitor *authMonitor) checkNewLoginIP(user string, ip string, lineTime time.Time) {
+
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+
+	if knownLogins == nil {
+		return
+	}
+
+	key := user + "@" + ip
+	lastSeen, known := knownLogins.KnownLoginIPs[key]
+	if known && lineTime.Before(lastSeen) {
+		return
+	}
+	knownLogins.KnownLoginIPs[key] = lineTime
+
+	if !known {
+		if !lineTime.Before(monitor.started) {
+			RaiseEvent(monitor.logPath, "new-login-ip", "User "+user+" logged in from new ip "+ip, false)
+		}
+		pruneKnownLogins(time.Now())
+		SaveData(knownLogins)
+	}
+}
+
+// Forgets the login ips that were not seen for a long time, so the data
+// file does not grow forever. Must be called with the dataMutex held.
+func pruneKnownLogins(now time.Time) {
+	for key, lastSeen := range knownLogins.KnownLoginIPs {
+		if now.Sub(lastSeen) > knownLoginMaxAge {
+			delete(knownLogins.KnownLoginIPs, key)
+		}
+	}
+}
+
+// Drops failures that fell out of the window, and raises an event for each
+// ip and user that went over the limit. The event recovers when all ips, or
+// all users, are back under it. The ip or user is in the message and not in
+// the name of the event, which would give the event metric a series per ip.
+func (monitor *authMonitor) checkBruteForce(now time.Time) {
+
+	monitor.checkFailures("ip", monitor.failuresByIP, now)
+	monitor.checkFailures("user", monitor.failuresByUser, now)
+
+	logSummariesMutex.Lock()
+	getLogSummary(monitor.logPath).BruteForceSources = int64(len(monitor.bruteForce))
+	logSummariesMutex.Unlock()
+}
+
+func (monitor *authMonitor) checkFailures(kind string, failures map[string][]time.Time, now time.Time) {
+
+	start := now.Add(-monitor.window)
+	eventName := "brute-force-" + kind
+	wasOverLimit := monitor.countOverLimit(kind) > 0
+
+	for name, all := range failures {
+
+		// The times come from the lines, which are not always in order
+		var times []time.Time
+		for _, failure := range all {
+			if !failure.Before(start) {
+				times = append(times, failure)
+			}
+		}
+
+		key := kind + " " + name
+		overLimit := len(times) > monitor.maxFailures
+
+		if overLimit && !monitor.bruteForce[key] {
+			monitor.bruteForce[key] = true
+			RaiseEvent(monitor.logPath, eventName, itoa(int64(len(times)))+" failed logins for "+key+" within "+monitor.window.String(), true)
+		} else if !overLimit {
+			delete(monitor.bruteForce, key)
+		}
+
+		if len(times) == 0 {
+			delete(failures, name)
+		} else {
+			failures[name] = times
+		}
+	}
+
+	if wasOverLimit && monitor.countOverLimit(kind) == 0 {
+		RaiseEvent(monitor.logPath, eventName, "Failed logins of all "+kind+"s back under the limit", false)
+	}
+}
+
+// Returns how many ips or users are over the limit right now
+func (monitor *authMonitor) countOverLimit(kind string) int {
+	count := 0
+	for key := range monitor.bruteForce {
+		if strings.HasPrefix(key, kind+" ") {
+			count++
+		}
+	}
+	return count
+}
+
+// An ip or user and the number of failed logins for it
+type AuthFailureCount struct {
+	Name  string
+	Count int64
+}
+
+// Returns the ips or users with the most failed logins, most first
+func topAuthFailures(failures map[string]int64) []AuthFailureCount {
+
+	var counts []AuthFailureCount
+	for name, count := range failures {
+		counts = append(counts, AuthFailureCount{name, count})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+
+	if len(counts) > topAuthFailureCount {
+		counts = counts[:topAuthFailureCount]
+	}
+
+	return counts
+}
+
+// Counts an auth event, and the failed logins per ip and user
+func countAuthEvent(logPath string, event string, user string, ip string, failedLogin bool) {
+	logSummariesMutex.Lock()
+
+	summary := getLogSummary(logPath)
+	if summary.AuthEventCount == nil {
+		summary.AuthEventCount = make(map[string]int64)
+	}
+	summary.AuthEventCount[event]++
+	logSummariesMutex.Unlock()
+
+	if !failedLogin {
+		return
+	}
+
+	failedLoginsMutex.Lock()
+	defer failedLoginsMutex.Unlock()
+
+	countFailedLogin(failedLoginsByIP, logPath, ip)
+	countFailedLogin(failedLoginsByUser, logPath, user)
+}
+
+// Must be called with the failedLoginsMutex held
+func countFailedLogin(failures map[string]map[string]int64, logPath string, name string) {
+
+	counts, ok := failures[logPath]
+	if !ok {
+		counts = make(map[string]int64)
+		failures[logPath] = counts
+	}
+
+	if _, ok := counts[name]; ok || len(counts) < maxTrackedAttackIPs {
+		counts[name]++
+	}
+}
+
+// Puts the ips and users with the most failed logins into the summaries,
+// once per tick
+func updateTopAuthFailures() {
+
+	failedLoginsMutex.Lock()
+	topIPs := make(map[string][]AuthFailureCount)
+	topUsers := make(map[string][]AuthFailureCount)
+	for logPath, counts := range failedLoginsByIP {
+		topIPs[logPath] = topAuthFailures(counts)
+	}
+	for logPath, counts := range failedLoginsByUser {
+		topUsers[logPath] = topAuthFailures(counts)
+	}
+	failedLoginsMutex.Unlock()
+
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	for logPath, counts := range topIPs {
+		getLogSummary(logPath).TopAuthFailureIPs = counts
+	}
+	for logPath, counts := range topUsers {
+		getLogSummary(logPath).TopAuthFailureUsers = counts
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthMonitorHandle(t *testing.T) {
+
+	monitor := newAuthMonitor(LogFile{Filepath: "test-auth.log", AuthMonitor: true})
+
+	tests := []struct {
+		program string
+		message string
+		event   string
+		user    string
+		ip      string
+	}{
+		{"sshd", "Failed password for root from 203.0.113.5 port 22 ssh2", "failed_password", "root", "203.0.113.5"},
+		{"sshd", "Failed password for invalid user admin from 203.0.113.6 port 22 ssh2", "failed_password", "admin", "203.0.113.6"},
+		{"sshd", "Invalid user oracle from 203.0.113.7 port 51234", "invalid_user", "oracle", "203.0.113.7"},
+		{"sshd", "Accepted publickey for mark from 198.51.100.1 port 4022 ssh2: RSA SHA256:abc", "accepted_publickey", "mark", "198.51.100.1"},
+		{"sudo", "    mark : TTY=pts/0 ; PWD=/home/mark ; USER=root ; COMMAND=/usr/bin/apt update", "sudo_command", "mark", ""},
+		{"sudo", "    mark : 3 incorrect password attempts ; TTY=pts/0 ; PWD=/home/mark ; USER=root ; COMMAND=/bin/ls", "sudo_failed", "mark", ""},
+		{"sshd", "Connection closed by 203.0.113.5 port 22", "", "", ""},
+		{"cron", "Failed password for root from 203.0.113.5 port 22 ssh2", "", "", ""},
+	}
+
+	for _, test := range tests {
+
+		values := map[string]interface{}{"program": test.program, "description": test.message}
+		monitor.handle(values, time.Now())
+
+		if event := authValue(values, "auth_event"); event != test.event {
+			t.Errorf("%s: event is %q, expected %q", test.message, event, test.event)
+		}
+		if user := authValue(values, "auth_user"); user != test.user {
+			t.Errorf("%s: user is %q, expected %q", test.message, user, test.user)
+		}
+		if ip := authValue(values, "auth_ip"); ip != test.ip {
+			t.Errorf("%s: ip is %q, expected %q", test.message, ip, test.ip)
+		}
+	}
+
+	values := map[string]interface{}{"program": "sudo", "description": "mark : USER=root ; COMMAND=/usr/bin/apt update"}
+	monitor.handle(values, time.Now())
+	if command := authValue(values, "auth_command"); command != "/usr/bin/apt update" {
+		t.Errorf("sudo command is %q, expected /usr/bin/apt update", command)
+	}
+}
+
+// Returns a value the auth monitor added, or an empty string if it did not
+func authValue(values map[string]interface{}, name string) string {
+	if value, ok := values[name]; ok {
+		return vtoa(value)
+	}
+	return ""
+}
+
+func TestAuthMonitorBruteForce(t *testing.T) {
+
+	monitor := newAuthMonitor(LogFile{Filepath: "test-brute-force.log", AuthMonitor: true, AuthMaxFailures: 3})
+
+	for len(events) > 0 {
+		<-events
+	}
+
+	failedLogin := func(message string, lineTime time.Time) {
+		monitor.handle(map[string]interface{}{"program": "sshd", "description": message}, lineTime)
+	}
+
+	// Old lines, like the ones read when lorona starts, do not count
+	for i := 0; i < 5; i++ {
+		failedLogin("Failed password for root from 203.0.113.5 port 22 ssh2", time.Now().Add(-time.Hour))
+	}
+
+	// Logins as a user that does not exist count as failed too, but only
+	// once for the two lines sshd writes for them
+	failedLogin("Failed password for root from 203.0.113.5 port 22 ssh2", time.Now())
+	failedLogin("Failed password for root from 203.0.113.5 port 22 ssh2", time.Now())
+	failedLogin("Invalid user oracle from 203.0.113.5 port 51234", time.Now())
+	failedLogin("Failed password for invalid user oracle from 203.0.113.5 port 51234 ssh2", time.Now())
+
+	if len(events) > 0 {
+		t.Errorf("raised %v with 3 failed logins, expected nothing", <-events)
+	}
+
+	failedLogin("Failed password for root from 203.0.113.5 port 22 ssh2", time.Now())
+
+	var raised []Event
+	for len(events) > 0 {
+		raised = append(raised, <-events)
+	}
+
+	if len(raised) != 1 || raised[0].Name != "brute-force-ip" || !raised[0].Firing || !strings.Contains(raised[0].Message, "203.0.113.5") {
+		t.Errorf("raised %v, expected a brute force event for the ip only", raised)
+	}
+
+	if len(monitor.bruteForce) != 1 {
+		t.Errorf("%d sources over the limit, expected 1", len(monitor.bruteForce))
+	}
+
+	// Once the failures are out of the window, the event recovers
+	monitor.checkBruteForce(time.Now().Add(time.Hour))
+
+	if len(events) != 1 {
+		t.Fatalf("%d events after the window, expected 1", len(events))
+	}
+	if event := <-events; event.Name != "brute-force-ip" || event.Firing {
+		t.Errorf("raised %v after the window, expected the brute force event to recover", event)
+	}
+}
+
+func TestAuthMonitorNewLoginIP(t *testing.T) {
+
+	var settings Settings
+	settings.DataFile = filepath.Join(t.TempDir(), "lorona.dat")
+	settings.KnownLoginIPs = map[string]time.Time{
+		"mark@198.51.100.1": time.Now().Add(-time.Hour),
+		"mark@198.51.100.9": time.Now().Add(-100 * 24 * time.Hour),
+	}
+
+	StartAuthMonitoring(&settings)
+	defer func() { knownLogins = nil }()
+
+	if _, ok := settings.KnownLoginIPs["mark@198.51.100.9"]; ok {
+		t.Errorf("a login ip not seen for 100 days is still known")
+	}
+
+	monitor := newAuthMonitor(LogFile{Filepath: "test-new-login.log", AuthMonitor: true})
+
+	for len(events) > 0 {
+		<-events
+	}
+
+	tests := []struct {
+		ip       string
+		lineTime time.Time
+		raised   bool
+	}{
+		{"198.51.100.1", time.Now(), false},
+		{"198.51.100.2", time.Now().Add(-time.Hour), false}, // Read when lorona started
+		{"198.51.100.2", time.Now(), false},
+		{"198.51.100.3", time.Now(), true},
+		{"198.51.100.9", time.Now(), true},
+	}
+
+	for _, test := range tests {
+
+		monitor.handle(map[string]interface{}{"program": "sshd", "description": "Accepted publickey for mark from " + test.ip + " port 4022 ssh2"}, test.lineTime)
+
+		raised := false
+		for len(events) > 0 {
+			event := <-events
+			raised = raised || event.Name == "new-login-ip"
+		}
+
+		if raised != test.raised {
+			t.Errorf("login from %s at %v raised new-login-ip %v, expected %v", test.ip, test.lineTime, raised, test.raised)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The settings for banning abusive clients, in the 'client-bans' section.
+// Logs with 'track-clients: true' count the requests and errors of each
+// client ip. An ip that goes over a limit within the window is banned, and
+// written to the ban list file, e.g to be included in the nginx config.
+type ClientBanRequest struct {
+	Window        string   `yaml:"window"`          // The sliding window the limits apply to, e.g 1m
+	MaxRequests   int64    `yaml:"max-requests"`    // Requests allowed per window, 0 means no limit
+	MaxErrors     int64    `yaml:"max-errors"`      // Responses with status 400 and up allowed per window, 0 means no limit
+	BanDuration   string   `yaml:"ban-duration"`    // How long a ban lasts, e.g 1h
+	BanListFile   string   `yaml:"ban-list-file"`   // Where the ban list is written
+	BanListFormat string   `yaml:"ban-list-format"` // nginx for 'deny <ip>;' lines, plain for one ip per line
+	OnBanCommand  string   `yaml:"on-ban-command"`  // Run on each ban and unban, with LORONA_BAN_IP and LORONA_BAN_ACTION set
+	Whitelist     []string `yaml:"whitelist"`       // Ips that are never banned
+}
+
+// A banned client, as shown in the results
+type ClientBan struct {
+	IP      string
+	Expires time.Time
+}
+
+// The requests and errors of a client in one second
+type activityBucket struct {
+	second   int64
+	requests int64
+	errors   int64
+}
+
+// The tracker uses the dataMutex, as the bans are kept in the settings
+// and persisted with them
+type clientTracker struct {
+	settings  *Settings
+	window    time.Duration
+	duration  time.Duration
+	whitelist map[string]bool
+	clients   map[string][]activityBucket
+}
+
+// There is one tracker for all logs, so an ip is judged on all its requests
+var clientBans *clientTracker
+
+// Sets up the tracker and starts expiring bans. Bans from the data file
+// are kept, so a restart does not lift them.
+func StartClientBans(settings *Settings) {
+
+	request := settings.ClientBanRequest
+	if request.MaxRequests <= 0 && request.MaxErrors <= 0 {
+		return
+	}
+
+	window, err := time.ParseDuration(request.Window)
+	if err != nil || window <= 0 {
+		window = time.Minute
+	}
+
+	duration, err := time.ParseDuration(request.BanDuration)
+	if err != nil || duration <= 0 {
+		duration = time.Hour
+	}
+
+	tracker := &clientTracker{}
+	tracker.settings = settings
+	tracker.window = window
+	tracker.duration = duration
+	tracker.whitelist = make(map[string]bool)
+	tracker.clients = make(map[string][]activityBucket)
+
+	for _, ip := range request.Whitelist {
+		tracker.whitelist[ip] = true
+	}
+
+	if settings.ActiveBans == nil {
+		settings.ActiveBans = make(map[string]time.Time)
+	}
+
+	// The data file could have been edited by hand
+	for ip := range settings.ActiveBans {
+		if !isBannableIP(ip) {
+			delete(settings.ActiveBans, ip)
+		}
+	}
+
+	dataMutex.Lock()
+	tracker.writeBanList()
+	clientBans = tracker
+	dataMutex.Unlock()
+
+	go tracker.expireBans()
+}
+
+// Counts a request of a client at the time of its line, and bans it if it
+// went over a limit. Lines older than the window, like the ones read when
+// lorona starts, are not counted, so old traffic cannot get an ip banned.
+func (tracker *clientTracker) record(ip string, statusCode string, lineTime time.Time) {
+
+	if tracker == nil || len(ip) == 0 || tracker.whitelist[ip] || !isBannableIP(ip) {
+		return
+	}
+
+	second := lineTime.Unix()
+	oldest := time.Now().Unix() - int64(tracker.window.Seconds())
+	if second <= oldest {
+		return
+	}
+
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+
+	if _, banned := tracker.settings.ActiveBans[ip]; banned {
+		return
+	}
+
+	// Drop the buckets that fell out of the window, and find the one of this
+	// second. Lines are not always in time order, so we look at all of them
+	var current *activityBucket
+	buckets := tracker.clients[ip][:0]
+	for _, bucket := range tracker.clients[ip] {
+		if bucket.second > oldest {
+			buckets = append(buckets, bucket)
+		}
+	}
+	for i := range buckets {
+		if buckets[i].second == second {
+			current = &buckets[i]
+		}
+	}
+	if current == nil {
+		buckets = append(buckets, activityBucket{second: second})
+		current = &buckets[len(buckets)-1]
+	}
+
+	current.requests++
+
+	if code, err := strconv.Atoi(statusCode); err == nil && code >= 400 {
+		current.errors++
+	}
+
+	tracker.clients[ip] = buckets
+
+	var requests, errors int64
+	for _, bucket := range buckets {
+		requests += bucket.requests
+		errors += bucket.errors
+	}
+
+	request := tracker.settings.ClientBanRequest
+	if request.MaxRequests > 0 && requests > request.MaxRequests {
+		tracker.ban(ip, itoa(requests)+" requests within "+tracker.window.String())
+	} else if request.MaxErrors > 0 && errors > request.MaxErrors {
+		tracker.ban(ip, itoa(errors)+" errors within "+tracker.window.String())
+	}
+}
+
+// Must be called with the mutex held
+func (tracker *clientTracker) ban(ip string, reason string) {
+
+	tracker.settings.ActiveBans[ip] = time.Now().Add(tracker.duration)
+	delete(tracker.clients, ip)
+
+	lLog.Print("Banning " + ip + ": " + reason)
+	RaiseEvent("client-bans", "client-banned", "Banned "+ip+" for "+tracker.duration.String()+": "+reason, true)
+
+	tracker.writeBanList()
+	tracker.runHook(ip, "ban")
+	SaveData(tracker.settings)
+}
+
+// Regularly lifts bans that expired, and forgets clients that were quiet
+// for longer than the window
+func (tracker *clientTracker) expireBans() {
+
+	for {
+		time.Sleep(30 * time.Second)
+
+		if stopLogMonitoring == true {
+			return
+		}
+
+		dataMutex.Lock()
+
+		changed := false
+		for ip, expires := range tracker.settings.ActiveBans {
+			if time.Now().After(expires) {
+				delete(tracker.settings.ActiveBans, ip)
+				changed = true
+
+				lLog.Print("Ban of " + ip + " expired")
+				tracker.runHook(ip, "unban")
+			}
+		}
+
+		oldest := time.Now().Add(-tracker.window).Unix()
+		for ip, buckets := range tracker.clients {
+			if len(buckets) == 0 || buckets[len(buckets)-1].second <= oldest {
+				delete(tracker.clients, ip)
+			}
+		}
+
+		// The ip is in the message and not in the name of the event, which
+		// would give the event metric a series per ip. So it only recovers
+		// when no ip is banned anymore.
+		if changed {
+			if len(tracker.settings.ActiveBans) == 0 {
+				RaiseEvent("client-bans", "client-banned", "All bans expired", false)
+			}
+			tracker.writeBanList()
+			SaveData(tracker.settings)
+		}
+
+		dataMutex.Unlock()
+	}
+}
+
+// Writes all banned ips to the ban list file. We write to a temporary file
+// first, so nginx never reads a half written list. Must be called with the
+// mutex held.
+func (tracker *clientTracker) writeBanList() {
+
+	request := tracker.settings.ClientBanRequest
+	if len(request.BanListFile) == 0 {
+		return
+	}
+
+	var ips []string
+	for ip := range tracker.settings.ActiveBans {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	content := "# Written by lorona, do not edit\n"
+	for _, ip := range ips {
+		if !isBannableIP(ip) {
+			continue
+		}
+		if request.BanListFormat == "plain" {
+			content += ip + "\n"
+		} else {
+			content += "deny " + ip + ";\n"
+		}
+	}
+
+	tempFile := request.BanListFile + ".tmp"
+	if err := os.WriteFile(tempFile, []byte(content), 0644); err != nil {
+		lLog.Print("Could not write ban list: " + err.Error())
+		return
+	}
+
+	if err := os.Rename(tempFile, request.BanListFile); err != nil {
+		lLog.Print("Could not write ban list: " + err.Error())
+	}
+}
+
+// The ip comes from the line, and is written into the nginx config and
+// passed to the ban command. Anything that is not an ip or a network, like
+// '1.2.3.4; allow all', must never get there.
+func isBannableIP(ip string) bool {
+	if net.ParseIP(ip) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(ip)
+	return err == nil
+}
+
+// Runs the command from the settings, e.g to reload nginx. It runs in its
+// own thread, so a slow command does not hold up the log monitoring.
+func (tracker *clientTracker) runHook(ip string, action string) {
+
+	command := tracker.settings.ClientBanRequest.OnBanCommand
+	if len(command) == 0 {
+		return
+	}
+
+	go func() {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), "LORONA_BAN_IP="+ip, "LORONA_BAN_ACTION="+action)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			lLog.Print("Ban command failed: " + err.Error() + " " + string(output))
+		}
+	}()
+}
+
+// Returns the current bans, for the results
+func CurrentBans() []ClientBan {
+
+	bans := []ClientBan{}
+	if clientBans == nil {
+		return bans
+	}
+
+	dataMutex.Lock()
+	defer dataMutex.Unlock()
+
+	for ip, expires := range clientBans.settings.ActiveBans {
+		bans = append(bans, ClientBan{ip, expires})
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+
+	return bans
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteBanList(t *testing.T) {
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"", "# Written by lorona, do not edit\ndeny 10.0.0.1;\ndeny 10.0.0.2;\n"},
+		{"nginx", "# Written by lorona, do not edit\ndeny 10.0.0.1;\ndeny 10.0.0.2;\n"},
+		{"plain", "# Written by lorona, do not edit\n10.0.0.1\n10.0.0.2\n"},
+	}
+
+	for _, test := range tests {
+
+		banListFile := filepath.Join(t.TempDir(), "banned.conf")
+
+		var settings Settings
+		settings.ClientBanRequest.BanListFile = banListFile
+		settings.ClientBanRequest.BanListFormat = test.format
+		settings.ActiveBans = map[string]time.Time{
+			"10.0.0.2":            time.Now().Add(time.Hour),
+			"10.0.0.1":            time.Now().Add(time.Minute),
+			"10.0.0.3; allow all": time.Now().Add(time.Minute),
+			"include /etc/passwd": time.Now().Add(time.Minute),
+		}
+
+		tracker := &clientTracker{settings: &settings}
+		tracker.writeBanList()
+
+		content, err := os.ReadFile(banListFile)
+		if err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+
+		if string(content) != test.expected {
+			t.Errorf("%q: ban list is %q, expected %q", test.format, content, test.expected)
+		}
+
+		if _, err := os.Stat(banListFile + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("%q: the temporary file was left behind", test.format)
+		}
+	}
+}
+
+func TestIsBannableIP(t *testing.T) {
+
+	tests := []struct {
+		ip       string
+		bannable bool
+	}{
+		{"203.0.113.5", true},
+		{"2001:db8::1", true},
+		{"203.0.113.0/24", true},
+		{"", false},
+		{"localhost", false},
+		{"203.0.113.5; allow all", false},
+		{"203.0.113.5\ndeny all", false},
+		{"$(reboot)", false},
+	}
+
+	for _, test := range tests {
+		if bannable := isBannableIP(test.ip); bannable != test.bannable {
+			t.Errorf("%q bannable is %v, expected %v", test.ip, bannable, test.bannable)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// We never read more than this of a body, unless max-body-size is larger
+const defaultMaxBodySize = 1024 * 1024
+
+var pageTitleRegex = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// Finds the parts of a path like $.data.items[0]['name']
+var jsonPathPartRegex = regexp.MustCompile(`\.([^.\[]+)|\[(\d+)\]|\['([^']*)'\]|\["([^"]*)"\]`)
+
+// Returns true if the checks of the endpoint need the body of the response
+func (uptimeRequest UptimeRequest) checksBody() bool {
+	return len(uptimeRequest.SearchFor) > 0 || len(uptimeRequest.SearchRegex) > 0 ||
+		len(uptimeRequest.JSONPath) > 0 || uptimeRequest.MaxBodySize > 0 || len(uptimeRequest.Extract) > 0
+}
+
+// Reads the body of the response. A body larger than max-body-size is an
+// error, without it we read up to 1MB and ignore the rest.
+func readBody(response *http.Response, maxBodySize int64) (string, error) {
+
+	limit := maxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodySize
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		return "", errors.New("Could not read body: " + err.Error())
+	}
+
+	if int64(len(body)) > limit {
+		if maxBodySize > 0 {
+			return "", errors.New("Body is larger than " + itoa(maxBodySize) + " bytes")
+		}
+		body = body[:limit]
+	}
+
+	return string(body), nil
+}
+
+// Returns the title of an html page, or nothing
+func pageTitle(body string) string {
+
+	match := pageTitleRegex.FindStringSubmatch(body)
+	if match == nil {
+		return ""
+	}
+
+	return strings.Join(strings.Fields(html.UnescapeString(match[1])), " ")
+}
+
+// Checks the headers and body of a response against the assertions of the
+// endpoint. Returns why the first failing assertion failed, or nothing if
+// all passed.
+func checkAssertions(uptimeRequest UptimeRequest, response *http.Response, body string) string {
+
+	for name, expected := range uptimeRequest.ExpectHeaders {
+		value := response.Header.Get(name)
+		if len(value) == 0 {
+			return "Header " + name + " is missing"
+		}
+		if !strings.Contains(value, expected) {
+			return "Header " + name + " is '" + value + "', expected '" + expected + "'"
+		}
+	}
+
+	if len(uptimeRequest.SearchFor) > 0 && !strings.Contains(body, uptimeRequest.SearchFor) {
+		return "Body does not contain '" + uptimeRequest.SearchFor + "'"
+	}
+
+	if len(uptimeRequest.SearchRegex) > 0 {
+		regex, err := regexp.Compile(uptimeRequest.SearchRegex)
+		if err != nil {
+			return "Invalid search-regex: " + err.Error()
+		}
+		if !regex.MatchString(body) {
+			return "Body does not match '" + uptimeRequest.SearchRegex + "'"
+		}
+	}
+
+	if len(uptimeRequest.JSONPath) > 0 {
+
+		var document interface{}
+		if err := json.Unmarshal([]byte(body), &document); err != nil {
+			return "Body is not json: " + err.Error()
+		}
+
+		for path, expected := range uptimeRequest.JSONPath {
+			value, ok := jsonPathValue(document, path)
+			if !ok {
+				return "Json path " + path + " not found"
+			}
+			if len(expected) > 0 && jsonValueString(value) != expected {
+				return "Json path " + path + " is '" + jsonValueString(value) + "', expected '" + expected + "'"
+			}
+		}
+	}
+
+	return ""
+}
+
+// Finds the value at a simple json path, e.g $.data.items[0].name
+func jsonPathValue(document interface{}, path string) (interface{}, bool) {
+
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "$") {
+		path = "$." + path
+	}
+
+	rest := path[1:]
+	value := document
+
+	for len(rest) > 0 {
+
+		location := jsonPathPartRegex.FindStringSubmatchIndex(rest)
+		if location == nil || location[0] != 0 {
+			return nil, false
+		}
+		match := jsonPathPartRegex.FindStringSubmatch(rest)
+		rest = rest[location[1]:]
+
+		if len(match[2]) > 0 {
+			list, ok := value.([]interface{})
+			index, _ := strconv.Atoi(match[2])
+			if !ok || index >= len(list) {
+				return nil, false
+			}
+			value = list[index]
+			continue
+		}
+
+		key := match[1] + match[3] + match[4]
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// Formats a json value to compare it with the expected text
+func jsonValueString(value interface{}) string {
+
+	switch typed := value.(type) {
+	case string:
+		return typed
+	case nil:
+		return "null"
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(typed)
+		return string(encoded)
+	}
+
+	return vtoa(value)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestJSONPathValue(t *testing.T) {
+
+	var document interface{}
+	body := `{"status": "ok", "data": {"items": [{"name": "first"}, {"name": "second", "size": 2.5}], "my key": true, "empty": null}}`
+	if err := json.Unmarshal([]byte(body), &document); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		value string
+		found bool
+	}{
+		{"$.status", "ok", true},
+		{"status", "ok", true},
+		{"$.data.items[1].name", "second", true},
+		{"$.data.items[1].size", "2.5", true},
+		{"$.data['my key']", "true", true},
+		{`$["data"]["empty"]`, "null", true},
+		{"$.data.items[0]", `{"name":"first"}`, true},
+		{"$.data.items[2].name", "", false},
+		{"$.data.missing", "", false},
+		{"$.status.name", "", false},
+		{"$.data.items.name", "", false},
+		{"$.data..items", "", false},
+	}
+
+	for _, test := range tests {
+
+		value, found := jsonPathValue(document, test.path)
+		if found != test.found {
+			t.Errorf("%s: found is %v, expected %v", test.path, found, test.found)
+			continue
+		}
+
+		if found && jsonValueString(value) != test.value {
+			t.Errorf("%s: value is %q, expected %q", test.path, jsonValueString(value), test.value)
+		}
+	}
+}
+
+func TestCheckAssertions(t *testing.T) {
+
+	response := &http.Response{Header: http.Header{}}
+	response.Header.Set("Content-Type", "application/json; charset=utf-8")
+	body := `{"status": "ok", "version": 3}`
+
+	tests := []struct {
+		name    string
+		request UptimeRequest
+		failed  bool
+	}{
+		{"no assertions", UptimeRequest{}, false},
+		{"header", UptimeRequest{ExpectHeaders: map[string]string{"content-type": "application/json"}}, false},
+		{"wrong header", UptimeRequest{ExpectHeaders: map[string]string{"Content-Type": "text/html"}}, true},
+		{"missing header", UptimeRequest{ExpectHeaders: map[string]string{"X-Version": ""}}, true},
+		{"search for", UptimeRequest{SearchFor: `"ok"`}, false},
+		{"search for missing text", UptimeRequest{SearchFor: "error"}, true},
+		{"search regex", UptimeRequest{SearchRegex: `"version": \d+`}, false},
+		{"search regex without match", UptimeRequest{SearchRegex: `"version": "`}, true},
+		{"invalid search regex", UptimeRequest{SearchRegex: `(`}, true},
+		{"json path", UptimeRequest{JSONPath: map[string]string{"$.status": "ok", "$.version": "3"}}, false},
+		{"json path exists", UptimeRequest{JSONPath: map[string]string{"$.version": ""}}, false},
+		{"json path with other value", UptimeRequest{JSONPath: map[string]string{"$.status": "down"}}, true},
+		{"missing json path", UptimeRequest{JSONPath: map[string]string{"$.uptime": ""}}, true},
+	}
+
+	for _, test := range tests {
+		reason := checkAssertions(test.request, response, body)
+		if (len(reason) > 0) != test.failed {
+			t.Errorf("%s: failed is %v (%q), expected %v", test.name, len(reason) > 0, reason, test.failed)
+		}
+	}
+
+	if reason := checkAssertions(UptimeRequest{JSONPath: map[string]string{"$.status": ""}}, response, "<html>"); len(reason) == 0 {
+		t.Errorf("a json path on a body that is not json passed")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Certificates change rarely, so we look at them less often than we check
+// the endpoint
+const certificateCheckInterval = time.Hour
+
+// The certificate an https endpoint presented
+type CertificateInfo struct {
+	Subject    string
+	Issuer     string
+	NotAfter   time.Time // When the first certificate of the chain expires
+	DaysLeft   int64
+	DNSNames   []string
+	CoversHost bool   // Set when the certificate is valid for the host name
+	ChainError string // Why the chain could not be verified, if it could not
+	Level      string // ok, warning, critical or expired, from the days left
+}
+
+// Connects to the host of an https url and looks at its certificates. The
+// connection does not verify them, so we can report on invalid ones too.
+func checkCertificate(uptimeRequest UptimeRequest) (*CertificateInfo, error) {
+
+	parsedUrl, err := url.Parse(uptimeRequest.checkUrl())
+	if err != nil {
+		return nil, err
+	}
+
+	host := parsedUrl.Hostname()
+	port := parsedUrl.Port()
+	if len(port) == 0 {
+		port = "443"
+	}
+
+	dialer := &net.Dialer{Timeout: uptimeRequest.timeout()}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil, errors.New("No certificate presented by " + host)
+	}
+
+	leaf := certificates[0]
+
+	info := &CertificateInfo{}
+	info.Subject = leaf.Subject.CommonName
+	if len(info.Subject) == 0 && len(leaf.DNSNames) > 0 {
+		info.Subject = leaf.DNSNames[0]
+	}
+	info.Issuer = leaf.Issuer.CommonName
+	info.DNSNames = leaf.DNSNames
+
+	// The chain is only as good as its first certificate to expire
+	info.NotAfter = leaf.NotAfter
+	for _, certificate := range certificates[1:] {
+		if certificate.NotAfter.Before(info.NotAfter) {
+			info.NotAfter = certificate.NotAfter
+		}
+	}
+	info.DaysLeft = int64(math.Floor(time.Until(info.NotAfter).Hours() / 24))
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{Intermediates: intermediates}); err != nil {
+		info.ChainError = err.Error()
+	}
+
+	info.CoversHost = leaf.VerifyHostname(host) == nil
+
+	switch {
+	case info.DaysLeft < 0:
+		info.Level = "expired"
+	case info.DaysLeft <= uptimeRequest.CertCriticalDays:
+		info.Level = "critical"
+	case info.DaysLeft <= uptimeRequest.CertWarningDays:
+		info.Level = "warning"
+	default:
+		info.Level = "ok"
+	}
+
+	return info, nil
+}
+
+// Raises events when the certificate of an endpoint starts or stops
+// expiring soon, and when it becomes invalid or valid again
+func raiseCertificateEvents(endpoint string, previous *CertificateInfo, current *CertificateInfo) {
+
+	previousLevel := "ok"
+	previousValid := true
+	if previous != nil {
+		previousLevel = previous.Level
+		previousValid = previous.valid()
+	}
+
+	if current.Level != previousLevel {
+		if current.Level == "ok" {
+			RaiseEvent(endpoint, "certificate-expiry", "Certificate renewed, expires "+ttoa(current.NotAfter), false)
+		} else if current.Level == "expired" {
+			RaiseEvent(endpoint, "certificate-expiry", "Certificate expired "+ttoa(current.NotAfter), true)
+		} else {
+			RaiseEvent(endpoint, "certificate-expiry", "Certificate expires in "+itoa(current.DaysLeft)+" days ("+current.Level+")", true)
+		}
+	}
+
+	if current.valid() != previousValid {
+		if current.valid() {
+			RaiseEvent(endpoint, "certificate-invalid", "Certificate is valid again", false)
+		} else if !current.CoversHost {
+			RaiseEvent(endpoint, "certificate-invalid", "Certificate does not cover the host, it is for "+current.Subject, true)
+		} else {
+			RaiseEvent(endpoint, "certificate-invalid", "Certificate chain is invalid: "+current.ChainError, true)
+		}
+	}
+}
+
+// Returns true if the chain verified and the certificate covers the host
+func (info *CertificateInfo) valid() bool {
+	return len(info.ChainError) == 0 && info.CoversHost
+}
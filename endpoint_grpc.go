@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The grpc status codes, by their number
+var grpcCodeNames = []string{"OK", "Canceled", "Unknown", "InvalidArgument", "DeadlineExceeded", "NotFound",
+	"AlreadyExists", "PermissionDenied", "ResourceExhausted", "FailedPrecondition", "Aborted", "OutOfRange",
+	"Unimplemented", "Internal", "Unavailable", "DataLoss", "Unauthenticated"}
+
+// The codes we return ourselves
+const (
+	grpcUnknown          = 2
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// The statuses of grpc.health.v1.HealthCheckResponse
+var grpcHealthStatusNames = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+const grpcHealthServing = 1
+
+// Asks a grpc server for its health with the standard health service,
+// grpc.health.v1.Health/Check. The url is the address, e.g
+// grpc://orders.internal:50051, or grpcs:// to connect with tls. The headers
+// of the check are sent as metadata. The response code is the grpc status
+// code of the call, e.g 0 for OK or 14 when the server cannot be reached.
+//
+// It is a single call with a message of one field, so we make it with the
+// http/2 client of the standard library instead of the grpc module.
+func checkGRPC(uptimeRequest UptimeRequest, tokens *tokenSource) UptimeResponse {
+
+	var uptime UptimeResponse
+	uptime.Endpoint = uptimeRequest.Endpoint
+
+	address := serviceAddress(uptimeRequest.Endpoint)
+
+	// grpc is always http/2, over tls or plain
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	url := "http://" + address + "/grpc.health.v1.Health/Check"
+
+	if strings.HasPrefix(strings.ToLower(uptimeRequest.Endpoint), "grpcs://") {
+		host := address
+		if splitHost, _, err := net.SplitHostPort(address); err == nil {
+			host = splitHost
+		}
+		transport.TLSClientConfig = &tls.Config{ServerName: host}
+		transport.Protocols.SetHTTP2(true)
+		url = "https://" + address + "/grpc.health.v1.Health/Check"
+	} else {
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	defer transport.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), uptimeRequest.timeout())
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(grpcHealthRequest(uptimeRequest.GRPCService)))
+	if err != nil {
+		uptime.ResponseCode = 598
+		uptime.ResponseValue = err.Error()
+		return uptime
+	}
+
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("TE", "trailers")
+	request.Header.Set("grpc-timeout", strconv.FormatInt(uptimeRequest.timeout().Milliseconds(), 10)+"m")
+
+	for name, value := range uptimeRequest.Headers {
+		request.Header.Set(strings.ToLower(name), value)
+	}
+
+	// Like the http checks, a server that needs a token is not checked
+	// without one
+	if tokens != nil {
+		token, err := tokens.get()
+		if err != nil {
+			uptime.TokenError = err.Error()
+			uptime.ResponseValue = "Could not get token: " + err.Error()
+			return uptime
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		uptime.TokenUsed = true
+	}
+
+	start := time.Now()
+	healthStatus, code, message := callGRPC(&http.Client{Transport: transport}, request)
+	uptime.ResponseTime = time.Since(start)
+
+	if code != 0 {
+		if tokens != nil && code == grpcUnauthenticated {
+			tokens.invalidate()
+		}
+		uptime.ResponseCode = code
+		uptime.ResponseValue = grpcCodeName(code) + ": " + message
+		return uptime
+	}
+
+	// SERVING is up, NOT_SERVING and UNKNOWN are down. A service the server
+	// does not know fails the call with NotFound
+	uptime.ResponseCode = 0
+	uptime.ResponseValue = grpcHealthStatusName(healthStatus)
+	uptime.Up = healthStatus == grpcHealthServing
+
+	return uptime
+}
+
+// Makes the call, and returns the status from the response message, the
+// grpc status code and its message
+func callGRPC(client *http.Client, request *http.Request) (int, int, string) {
+
+	response, err := client.Do(request)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0, grpcDeadlineExceeded, err.Error()
+		}
+		return 0, grpcUnavailable, err.Error()
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, grpcCodeFromHTTP(response.StatusCode), "http status " + strconv.Itoa(response.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	if err != nil {
+		return 0, grpcUnavailable, err.Error()
+	}
+
+	// The status is in the trailers, or in the headers when the server
+	// answers without a message
+	grpcStatus := response.Trailer.Get("grpc-status")
+	grpcMessage := response.Trailer.Get("grpc-message")
+	if len(grpcStatus) == 0 {
+		grpcStatus = response.Header.Get("grpc-status")
+		grpcMessage = response.Header.Get("grpc-message")
+	}
+
+	code, err := strconv.Atoi(grpcStatus)
+	if err != nil {
+		return 0, grpcUnknown, "no grpc-status in the response"
+	}
+	if code != 0 {
+		return 0, code, grpcMessage
+	}
+
+	healthStatus, err := grpcHealthResponse(body)
+	if err != nil {
+		return 0, grpcInternal, err.Error()
+	}
+
+	return healthStatus, 0, ""
+}
+
+// Encodes a HealthCheckRequest with its service, in a grpc message frame:
+// no compression, the length and the protobuf message
+func grpcHealthRequest(service string) []byte {
+
+	var message []byte
+	if len(service) > 0 {
+		message = append(message, 0x0a) // Field 1, a string
+		message = binary.AppendUvarint(message, uint64(len(service)))
+		message = append(message, service...)
+	}
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+	return append(frame, message...)
+}
+
+// Returns the status of a HealthCheckResponse in a grpc message frame. It
+// is 0, UNKNOWN, when the field is not set.
+func grpcHealthResponse(body []byte) (int, error) {
+
+	if len(body) < 5 {
+		return 0, errors.New("Response has no message")
+	}
+	if body[0] != 0 {
+		return 0, errors.New("Response message is compressed")
+	}
+
+	length := binary.BigEndian.Uint32(body[1:5])
+	if uint64(len(body)-5) < uint64(length) {
+		return 0, errors.New("Response message is cut off")
+	}
+	message := body[5 : 5+length]
+
+	healthStatus := 0
+	for len(message) > 0 {
+
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("Invalid response message")
+		}
+		message = message[n:]
+
+		// Field 1 is the status, the other fields are skipped
+		switch key & 7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, errors.New("Invalid response message")
+			}
+			message = message[n:]
+			if key>>3 == 1 {
+				healthStatus = int(value)
+			}
+		case 1:
+			if len(message) < 8 {
+				return 0, errors.New("Invalid response message")
+			}
+			message = message[8:]
+		case 2:
+			size, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < size {
+				return 0, errors.New("Invalid response message")
+			}
+			message = message[n+int(size):]
+		case 5:
+			if len(message) < 4 {
+				return 0, errors.New("Invalid response message")
+			}
+			message = message[4:]
+		default:
+			return 0, errors.New("Invalid response message")
+		}
+	}
+
+	return healthStatus, nil
+}
+
+// The grpc code for an http error, as in the grpc spec
+func grpcCodeFromHTTP(statusCode int) int {
+	switch statusCode {
+	case 400:
+		return grpcInternal
+	case 401:
+		return grpcUnauthenticated
+	case 403:
+		return grpcPermissionDenied
+	case 404:
+		return grpcUnimplemented
+	case 429, 502, 503, 504:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+func grpcCodeName(code int) string {
+	if code >= 0 && code < len(grpcCodeNames) {
+		return grpcCodeNames[code]
+	}
+	return "Code(" + strconv.Itoa(code) + ")"
+}
+
+func grpcHealthStatusName(healthStatus int) string {
+	if healthStatus >= 0 && healthStatus < len(grpcHealthStatusNames) {
+		return grpcHealthStatusNames[healthStatus]
+	}
+	return "STATUS(" + strconv.Itoa(healthStatus) + ")"
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGRPCHealthRequest(t *testing.T) {
+
+	tests := []struct {
+		service string
+		request []byte
+	}{
+		{"", []byte{0, 0, 0, 0, 0}},
+		{"orders", []byte{0, 0, 0, 0, 8, 0x0a, 6, 'o', 'r', 'd', 'e', 'r', 's'}},
+	}
+
+	for _, test := range tests {
+		if request := grpcHealthRequest(test.service); !bytes.Equal(request, test.request) {
+			t.Errorf("request for %q is %v, expected %v", test.service, request, test.request)
+		}
+	}
+}
+
+func TestGRPCHealthResponse(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		body         []byte
+		healthStatus int
+		failed       bool
+	}{
+		{"serving", []byte{0, 0, 0, 0, 2, 0x08, 1}, grpcHealthServing, false},
+		{"not serving", []byte{0, 0, 0, 0, 2, 0x08, 2}, 2, false},
+		{"status not set", []byte{0, 0, 0, 0, 0}, 0, false},
+		{
+			// A string, a fixed64, a fixed32 and a varint field we do not know
+			"skipped fields",
+			[]byte{0, 0, 0, 0, 24, 0x12, 3, 'a', 'b', 'c', 0x19, 1, 2, 3, 4, 5, 6, 7, 8, 0x25, 1, 2, 3, 4, 0x08, 1, 0x30, 0x96, 0x01},
+			grpcHealthServing, false,
+		},
+		{"bytes after the message", []byte{0, 0, 0, 0, 2, 0x08, 1, 0, 0}, grpcHealthServing, false},
+		{"no message", []byte{0, 0, 0}, 0, true},
+		{"compressed", []byte{1, 0, 0, 0, 2, 0x08, 1}, 0, true},
+		{"cut off frame", []byte{0, 0, 0, 0, 9, 0x08, 1}, 0, true},
+		{"cut off string field", []byte{0, 0, 0, 0, 3, 0x12, 5, 'a'}, 0, true},
+		{"cut off fixed64 field", []byte{0, 0, 0, 0, 3, 0x19, 1, 2}, 0, true},
+		{"cut off varint", []byte{0, 0, 0, 0, 2, 0x08, 0x96}, 0, true},
+		{"unknown wire type", []byte{0, 0, 0, 0, 2, 0x0b, 1}, 0, true},
+	}
+
+	for _, test := range tests {
+
+		healthStatus, err := grpcHealthResponse(test.body)
+		if (err != nil) != test.failed {
+			t.Errorf("%s: error is %v, expected an error %v", test.name, err, test.failed)
+			continue
+		}
+
+		if healthStatus != test.healthStatus {
+			t.Errorf("%s: status is %d, expected %d", test.name, healthStatus, test.healthStatus)
+		}
+	}
+}
+
+func TestCheckGRPC(t *testing.T) {
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/grpc.health.v1.Health/Check" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		service := string(body[7:])
+
+		switch service {
+		case "orders":
+			w.Header().Set("Trailer", "grpc-status")
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write([]byte{0, 0, 0, 0, 2, 0x08, 1})
+			w.Header().Set("grpc-status", "0")
+		case "stock":
+			w.Header().Set("Trailer", "grpc-status")
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Write([]byte{0, 0, 0, 0, 2, 0x08, 2})
+			w.Header().Set("grpc-status", "0")
+		case "gone":
+			// Trailers-only: the status is in the headers and there is no body
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("grpc-status", "5")
+			w.Header().Set("grpc-message", "unknown service gone")
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		service string
+		up      bool
+		code    int
+		value   string
+	}{
+		{"orders", true, 0, "SERVING"},
+		{"stock", false, 0, "NOT_SERVING"},
+		{"gone", false, 5, "NotFound: unknown service gone"},
+		{"busy", false, grpcUnavailable, "Unavailable: http status 503"},
+	}
+
+	for _, test := range tests {
+
+		uptime := checkGRPC(UptimeRequest{Endpoint: "grpc://" + address, GRPCService: test.service}, nil)
+
+		if uptime.Up != test.up || uptime.ResponseCode != test.code || uptime.ResponseValue != test.value {
+			t.Errorf("%s: up %v, code %d, value %q, expected up %v, code %d, value %q",
+				test.service, uptime.Up, uptime.ResponseCode, uptime.ResponseValue, test.up, test.code, test.value)
+		}
+	}
+}
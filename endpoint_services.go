@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Checks a service that does not speak http, by the 'type' of the uptime
+// entry. The url is the address, e.g db.internal:5432, or the name to
+// resolve for dns.
+func checkService(uptimeRequest UptimeRequest) UptimeResponse {
+
+	var uptime UptimeResponse
+	uptime.Endpoint = uptimeRequest.Endpoint
+
+	start := time.Now()
+
+	switch uptimeRequest.Type {
+	case "tcp":
+		checkTCP(uptimeRequest, &uptime)
+	case "udp":
+		checkUDP(uptimeRequest, &uptime)
+	case "dns":
+		checkDNS(uptimeRequest, &uptime)
+	default:
+		uptime.ResponseValue = "Unknown check type " + uptimeRequest.Type
+	}
+
+	uptime.ResponseTime = time.Since(start)
+
+	return uptime
+}
+
+// Connects, and if set, sends the text and waits for the expected text,
+// e.g the banner of an smtp server
+func checkTCP(uptimeRequest UptimeRequest, uptime *UptimeResponse) {
+
+	timeout := uptimeRequest.timeout()
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", serviceAddress(uptimeRequest.Endpoint), timeout)
+	uptime.Timing.TCPConnect = time.Since(start)
+
+	if err != nil {
+		// We use code 598 for an error like 'host not found'
+		uptime.ResponseCode = 598
+		uptime.ResponseValue = err.Error()
+		return
+	}
+	defer conn.Close()
+
+	if len(uptimeRequest.Send) == 0 && len(uptimeRequest.Expect) == 0 {
+		uptime.Up = true
+		return
+	}
+
+	exchange(conn, uptimeRequest, uptime)
+}
+
+// Sends the text and waits for the expected answer. Udp has no connection,
+// so the answer is the only sign that the service is up.
+func checkUDP(uptimeRequest UptimeRequest, uptime *UptimeResponse) {
+
+	conn, err := net.DialTimeout("udp", serviceAddress(uptimeRequest.Endpoint), uptimeRequest.timeout())
+	if err != nil {
+		uptime.ResponseCode = 598
+		uptime.ResponseValue = err.Error()
+		return
+	}
+	defer conn.Close()
+
+	if len(uptimeRequest.Send) == 0 {
+		uptime.ResponseValue = "Udp checks need something to send"
+		return
+	}
+
+	exchange(conn, uptimeRequest, uptime)
+}
+
+// Sends the text of the check and reads the answer. The check is up if the
+// answer contains the expected text, or if anything came back when no text
+// is expected.
+func exchange(conn net.Conn, uptimeRequest UptimeRequest, uptime *UptimeResponse) {
+
+	conn.SetDeadline(time.Now().Add(uptimeRequest.timeout()))
+
+	start := time.Now()
+
+	if len(uptimeRequest.Send) > 0 {
+		if _, err := conn.Write([]byte(uptimeRequest.Send)); err != nil {
+			uptime.ResponseValue = "Could not send: " + err.Error()
+			return
+		}
+	}
+
+	// Read until the expected text came, the other side stopped, or the
+	// time is up
+	var received []byte
+	buffer := make([]byte, 4096)
+	for len(received) < defaultMaxBodySize {
+
+		count, err := conn.Read(buffer)
+		if count > 0 && len(received) == 0 {
+			uptime.Timing.TimeToFirstByte = time.Since(start)
+		}
+		received = append(received, buffer[:count]...)
+
+		if err != nil || len(uptimeRequest.Expect) == 0 || strings.Contains(string(received), uptimeRequest.Expect) {
+			break
+		}
+	}
+
+	// Shown in the results, so we keep it short
+	answer := string(received)
+	if len(answer) > 200 {
+		answer = answer[:200]
+	}
+	uptime.ResponseValue = strings.TrimSpace(answer)
+
+	if len(received) == 0 {
+		uptime.ResponseValue = "No answer"
+		return
+	}
+
+	if len(uptimeRequest.Expect) > 0 && !strings.Contains(string(received), uptimeRequest.Expect) {
+		uptime.ResponseValue = "Expected '" + uptimeRequest.Expect + "', got '" + uptime.ResponseValue + "'"
+		return
+	}
+
+	uptime.Up = true
+}
+
+// Resolves the name against the dns server of the check, and makes sure
+// the expected records are in the answer
+func checkDNS(uptimeRequest UptimeRequest, uptime *UptimeResponse) {
+
+	resolver := net.DefaultResolver
+	if len(uptimeRequest.DNSServer) > 0 {
+		server := uptimeRequest.DNSServer
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				dialer := net.Dialer{}
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), uptimeRequest.timeout())
+	defer cancel()
+
+	name := serviceAddress(uptimeRequest.Endpoint)
+
+	start := time.Now()
+	records, err := lookupRecords(ctx, resolver, strings.ToUpper(uptimeRequest.RecordType), name)
+	uptime.Timing.DNSLookup = time.Since(start)
+
+	if err != nil {
+		uptime.ResponseCode = 598
+		uptime.ResponseValue = err.Error()
+		return
+	}
+
+	sort.Strings(records)
+	uptime.ResponseValue = strings.Join(records, ", ")
+
+	if len(records) == 0 {
+		uptime.ResponseValue = "No records"
+		return
+	}
+
+	for _, expected := range uptimeRequest.ExpectRecords {
+		found := false
+		for _, record := range records {
+			if strings.EqualFold(strings.TrimSuffix(record, "."), strings.TrimSuffix(expected, ".")) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			uptime.ResponseValue = "Expected record " + expected + ", got " + uptime.ResponseValue
+			return
+		}
+	}
+
+	uptime.Up = true
+}
+
+// Returns the records of a type as text, e.g the addresses for A
+func lookupRecords(ctx context.Context, resolver *net.Resolver, recordType string, name string) ([]string, error) {
+
+	var records []string
+
+	switch recordType {
+	case "", "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		addresses, err := resolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			records = append(records, address.String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			records = append(records, mx.Host)
+		}
+	case "NS":
+		nss, err := resolver.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			records = append(records, ns.Host)
+		}
+	case "TXT":
+		txts, err := resolver.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, txts...)
+	default:
+		return nil, errors.New("Unsupported record type " + recordType)
+	}
+
+	return records, nil
+}
+
+// The url of a tcp, udp or dns check may have a scheme, e.g tcp://db:5432
+func serviceAddress(endpoint string) string {
+	if index := strings.Index(endpoint, "://"); index >= 0 {
+		return endpoint[index+3:]
+	}
+	return endpoint
+}
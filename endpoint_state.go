@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// The states of an endpoint. A failed check makes an up endpoint failing,
+// and it is only down after 'fail-after' failed checks in a row. In the same
+// way a down endpoint is recovering until 'recover-after' good checks.
+const (
+	endpointUnknown    = "unknown"
+	endpointUp         = "up"
+	endpointFailing    = "failing"
+	endpointDown       = "down"
+	endpointRecovering = "recovering"
+)
+
+// Keeps the state of an endpoint between its checks
+type endpointState struct {
+	endpoint      string
+	failAfter     int
+	recoverAfter  int
+	flapThreshold int
+	flapWindow    time.Duration
+	state         string
+	failures      int         // Failed checks in a row
+	successes     int         // Good checks in a row
+	lastResult    bool        // The result of the last check
+	changes       []time.Time // When the result of a check differed from the one before
+	flapping      bool
+}
+
+func newEndpointState(uptimeRequest UptimeRequest) *endpointState {
+
+	state := &endpointState{}
+	state.endpoint = uptimeRequest.Endpoint
+	state.failAfter = uptimeRequest.FailAfter
+	state.recoverAfter = uptimeRequest.RecoverAfter
+	state.flapThreshold = uptimeRequest.FlapThreshold
+	state.state = endpointUnknown
+
+	flapWindow, err := time.ParseDuration(uptimeRequest.FlapWindow)
+	if err != nil || flapWindow <= 0 {
+		flapWindow = time.Hour
+	}
+	state.flapWindow = flapWindow
+
+	if state.failAfter <= 0 {
+		state.failAfter = 1
+	}
+	if state.recoverAfter <= 0 {
+		state.recoverAfter = 1
+	}
+
+	return state
+}
+
+// Moves the state on with the result of a check, and adds the state to it
+func (state *endpointState) update(uptime *UptimeResponse) {
+
+	now := time.Now()
+
+	if state.state != endpointUnknown && uptime.Up != state.lastResult {
+		state.changes = append(state.changes, now)
+	}
+	state.lastResult = uptime.Up
+
+	if uptime.Up {
+		state.successes++
+		state.failures = 0
+	} else {
+		state.failures++
+		state.successes = 0
+	}
+
+	previous := state.state
+
+	// An endpoint that was never up stays unknown while its failures count
+	// towards 'fail-after', it is not failing since it was not up before
+	switch state.state {
+	case endpointUnknown:
+		if uptime.Up {
+			state.state = endpointUp
+		} else if state.failures >= state.failAfter {
+			state.state = endpointDown
+		}
+	case endpointUp, endpointFailing:
+		if uptime.Up {
+			state.state = endpointUp
+		} else if state.failures >= state.failAfter {
+			state.state = endpointDown
+		} else {
+			state.state = endpointFailing
+		}
+	case endpointDown, endpointRecovering:
+		if !uptime.Up {
+			state.state = endpointDown
+		} else if state.successes >= state.recoverAfter {
+			state.state = endpointUp
+		} else {
+			state.state = endpointRecovering
+		}
+	}
+
+	if state.state == endpointDown && previous != endpointDown {
+		RaiseEvent(state.endpoint, "endpoint-down", "Endpoint is down, status "+strconv.Itoa(uptime.ResponseCode)+" "+uptime.ResponseValue, true)
+	} else if state.state == endpointUp && (previous == endpointDown || previous == endpointRecovering) {
+		RaiseEvent(state.endpoint, "endpoint-down", "Endpoint is up again", false)
+	}
+
+	state.checkFlapping(now)
+
+	uptime.State = state.state
+	uptime.Flapping = state.flapping
+}
+
+// An endpoint is flapping when its checks changed between good and failed
+// too often within the window
+func (state *endpointState) checkFlapping(now time.Time) {
+
+	if state.flapThreshold <= 0 {
+		return
+	}
+
+	start := now.Add(-state.flapWindow)
+	first := 0
+	for first < len(state.changes) && state.changes[first].Before(start) {
+		first++
+	}
+	state.changes = state.changes[first:]
+
+	flapping := len(state.changes) >= state.flapThreshold
+
+	if flapping && !state.flapping {
+		RaiseEvent(state.endpoint, "endpoint-flapping", itoa(int64(len(state.changes)))+" changes within "+state.flapWindow.String(), true)
+	} else if !flapping && state.flapping {
+		RaiseEvent(state.endpoint, "endpoint-flapping", "Endpoint is stable again", false)
+	}
+
+	state.flapping = flapping
+}
+
+// Returns true if the endpoint counts as up. A failing endpoint is still up
+// until it failed 'fail-after' times, and a recovering one is still down.
+// Without a state, or before the first good check, only the result of the
+// check is known.
+func endpointStateUp(uptime UptimeResponse) bool {
+	if len(uptime.State) == 0 || uptime.State == endpointUnknown {
+		return uptime.Up
+	}
+	return uptime.State == endpointUp || uptime.State == endpointFailing
+}
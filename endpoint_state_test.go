@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestEndpointStateUpdate(t *testing.T) {
+
+	tests := []struct {
+		name         string
+		failAfter    int
+		recoverAfter int
+		results      []bool
+		states       []string
+	}{
+		{
+			name:    "first check is good",
+			results: []bool{true},
+			states:  []string{endpointUp},
+		},
+		{
+			name:      "failing from the start",
+			failAfter: 3,
+			results:   []bool{false, false, false},
+			states:    []string{endpointUnknown, endpointUnknown, endpointDown},
+		},
+		{
+			name:      "a good check resets the failures",
+			failAfter: 2,
+			results:   []bool{true, false, true, false, false},
+			states:    []string{endpointUp, endpointFailing, endpointUp, endpointFailing, endpointDown},
+		},
+		{
+			name:         "recovering needs good checks in a row",
+			recoverAfter: 2,
+			results:      []bool{false, true, false, true, true},
+			states:       []string{endpointDown, endpointRecovering, endpointDown, endpointRecovering, endpointUp},
+		},
+	}
+
+	for _, test := range tests {
+
+		state := newEndpointState(UptimeRequest{Endpoint: test.name, FailAfter: test.failAfter, RecoverAfter: test.recoverAfter})
+
+		for i, result := range test.results {
+
+			uptime := UptimeResponse{Endpoint: test.name, Up: result}
+			state.update(&uptime)
+
+			if uptime.State != test.states[i] {
+				t.Errorf("%s: state after check %d is %s, expected %s", test.name, i+1, uptime.State, test.states[i])
+			}
+
+			up := test.states[i] == endpointUp || test.states[i] == endpointFailing || (test.states[i] == endpointUnknown && result)
+			if endpointStateUp(uptime) != up {
+				t.Errorf("%s: endpoint after check %d counts as up %v, expected %v", test.name, i+1, !up, up)
+			}
+		}
+
+		// The changes of state raise events, which nothing reads here
+		for len(events) > 0 {
+			<-events
+		}
+	}
+}
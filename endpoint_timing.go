@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// How long each part of an http check took. With redirects, these are the
+// times of the last request. A part that was not measured, like the tls of a
+// plain http check or all but the connect of a tcp check, stays 0.
+type HTTPTiming struct {
+	DNSLookup       time.Duration
+	TCPConnect      time.Duration
+	TLSHandshake    time.Duration
+	TimeToFirstByte time.Duration // From sending the request until the first byte of the response, the time the server needed
+	ContentTransfer time.Duration // From the first byte until the body was read
+}
+
+// Returns the parts that were measured, by the name we publish them with
+func (timing HTTPTiming) phases() map[string]time.Duration {
+
+	phases := make(map[string]time.Duration)
+	for name, duration := range map[string]time.Duration{
+		"dns":        timing.DNSLookup,
+		"connect":    timing.TCPConnect,
+		"tls":        timing.TLSHandshake,
+		"first_byte": timing.TimeToFirstByte,
+		"transfer":   timing.ContentTransfer,
+	} {
+		if duration > 0 {
+			phases[name] = duration
+		}
+	}
+
+	return phases
+}
+
+// Records the times of the parts of a request as they happen. When a host
+// has several addresses, the connections to them are tried at the same
+// time, so the connect times are kept per address. Only the one of the
+// connection the request got counts, a dial that lost can still finish
+// after the request is done.
+type timingTrace struct {
+	timing        *HTTPTiming
+	dnsStart      time.Time
+	connectStarts map[string]time.Time
+	connectTimes  map[string]time.Duration
+	gotConn       bool
+	tlsStart      time.Time
+	wroteRequest  time.Time
+	firstByte     time.Time
+	mutex         sync.Mutex
+}
+
+func newTimingTrace(timing *HTTPTiming) *timingTrace {
+	return &timingTrace{timing: timing, connectStarts: make(map[string]time.Time), connectTimes: make(map[string]time.Duration)}
+}
+
+// Returns the hooks to pass to the request with httptrace.WithClientTrace
+func (trace *timingTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			trace.dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			trace.timing.DNSLookup = time.Since(trace.dnsStart)
+		},
+		GetConn: func(hostPort string) {
+			// Each request of a redirect gets a connection of its own
+			trace.mutex.Lock()
+			defer trace.mutex.Unlock()
+			trace.gotConn = false
+		},
+		ConnectStart: func(network string, addr string) {
+			trace.mutex.Lock()
+			defer trace.mutex.Unlock()
+			if !trace.gotConn {
+				trace.connectStarts[addr] = time.Now()
+			}
+		},
+		ConnectDone: func(network string, addr string, err error) {
+			trace.mutex.Lock()
+			defer trace.mutex.Unlock()
+			if err == nil && !trace.gotConn {
+				trace.connectTimes[addr] = time.Since(trace.connectStarts[addr])
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace.mutex.Lock()
+			defer trace.mutex.Unlock()
+			trace.gotConn = true
+
+			// A connection that was used before was not connected for this request
+			if !info.Reused && info.Conn != nil {
+				trace.timing.TCPConnect = trace.connectTimes[info.Conn.RemoteAddr().String()]
+			}
+		},
+		TLSHandshakeStart: func() {
+			trace.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			trace.timing.TLSHandshake = time.Since(trace.tlsStart)
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			trace.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			trace.firstByte = time.Now()
+			trace.timing.TimeToFirstByte = trace.firstByte.Sub(trace.wroteRequest)
+		},
+	}
+}
+
+// To be called when the body was read
+func (trace *timingTrace) bodyRead() {
+	if !trace.firstByte.IsZero() {
+		trace.timing.ContentTransfer = time.Since(trace.firstByte)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+)
+
+func TestTimingTrace(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	for _, path := range []string{"/new", "/old"} {
+
+		var timing HTTPTiming
+		trace := newTimingTrace(&timing)
+
+		request, _ := http.NewRequest("GET", server.URL+path, nil)
+		request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace.clientTrace()))
+
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(response.Body)
+		response.Body.Close()
+		trace.bodyRead()
+
+		phases := timing.phases()
+
+		// The connection of the first request is used again, so it is
+		// only connected once. There is no dns or tls for a plain ip.
+		if _, ok := phases["connect"]; ok != (path == "/new") {
+			t.Errorf("%s: connect measured %v, expected %v", path, ok, path == "/new")
+		}
+		for _, name := range []string{"dns", "tls"} {
+			if _, ok := phases[name]; ok {
+				t.Errorf("%s: %s was measured", path, name)
+			}
+		}
+		if _, ok := phases["first_byte"]; !ok {
+			t.Errorf("%s: first byte was not measured", path)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The settings for getting a token with the OAuth2 client credentials flow
+type OAuth2Request struct {
+	TokenUrl     string   `yaml:"token-url"`
+	ClientID     string   `yaml:"client-id"`
+	ClientSecret string   `yaml:"client-secret"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// We get a new token this long before the old one expires, so a check
+// never uses a token that expires while it runs
+const tokenExpiryMargin = 30 * time.Second
+
+// Gets the token for an endpoint that needs one, and keeps it until it
+// expires. Tokens without an expiry are kept until the endpoint rejects them.
+type tokenSource struct {
+	uptimeRequest UptimeRequest
+	client        *http.Client
+	token         string
+	expires       time.Time
+}
+
+// The fields of a token response we understand. The OAuth2 ones are
+// also used by most other token urls
+type tokenResponse struct {
+	AccessToken string      `json:"access_token"`
+	Token       string      `json:"token"`
+	ExpiresIn   json.Number `json:"expires_in"`
+}
+
+// Returns nothing if the endpoint does not need a token
+func newTokenSource(uptimeRequest UptimeRequest, client *http.Client) *tokenSource {
+
+	if len(uptimeRequest.GetTokenUrl) == 0 && len(uptimeRequest.OAuth2.TokenUrl) == 0 {
+		return nil
+	}
+
+	return &tokenSource{uptimeRequest: uptimeRequest, client: client}
+}
+
+// Returns the cached token, or gets a new one if it expired
+func (source *tokenSource) get() (string, error) {
+
+	if len(source.token) > 0 && (source.expires.IsZero() || time.Now().Before(source.expires)) {
+		return source.token, nil
+	}
+
+	token, expiresIn, err := source.fetch()
+	if err != nil {
+		source.token = ""
+		return "", err
+	}
+
+	source.token = token
+	source.expires = time.Time{}
+	if expiresIn > 0 {
+		source.expires = time.Now().Add(expiresIn - tokenExpiryMargin)
+	}
+
+	return token, nil
+}
+
+// Drops the token, e.g when the endpoint says it is no longer valid
+func (source *tokenSource) invalidate() {
+	source.token = ""
+}
+
+// Calls the token url. The token can be in a json response, or be the
+// whole response.
+func (source *tokenSource) fetch() (string, time.Duration, error) {
+
+	var request *http.Request
+	var err error
+
+	if oauth2 := source.uptimeRequest.OAuth2; len(oauth2.TokenUrl) > 0 {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		if len(oauth2.Scopes) > 0 {
+			form.Set("scope", strings.Join(oauth2.Scopes, " "))
+		}
+
+		request, err = http.NewRequest(http.MethodPost, oauth2.TokenUrl, strings.NewReader(form.Encode()))
+		if err == nil {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			request.SetBasicAuth(url.QueryEscape(oauth2.ClientID), url.QueryEscape(oauth2.ClientSecret))
+		}
+	} else {
+		request, err = http.NewRequest(http.MethodGet, source.uptimeRequest.GetTokenUrl, nil)
+	}
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	request.Header.Set("Accept", "application/json")
+
+	response, err := source.client.Do(request)
+	if err != nil {
+		return "", 0, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, defaultMaxBodySize))
+	if err != nil {
+		return "", 0, err
+	}
+
+	if response.StatusCode/100 != 2 {
+		return "", 0, errors.New("Token url returned status " + strconv.Itoa(response.StatusCode))
+	}
+
+	var parsed tokenResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		// Not json, so the body is the token
+		token := strings.TrimSpace(string(body))
+		if len(token) == 0 {
+			return "", 0, errors.New("Token url returned no token")
+		}
+		return token, 0, nil
+	}
+
+	token := parsed.AccessToken
+	if len(token) == 0 {
+		token = parsed.Token
+	}
+	if len(token) == 0 {
+		return "", 0, errors.New("Token url returned no access_token or token")
+	}
+
+	seconds, _ := parsed.ExpiresIn.Int64()
+	return token, time.Duration(seconds) * time.Second, nil
+}
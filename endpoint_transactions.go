@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The result of one step of a transaction check
+type StepResult struct {
+	Name          string
+	ResponseCode  int
+	ResponseValue string
+	ResponseTime  time.Duration
+	Timing        HTTPTiming
+	Up            bool
+}
+
+// Finds the variables in a step, e.g {{token}}. A value is put in as it is,
+// or escaped for a url with {{urlencode token}} or for a json string with
+// {{json token}}
+var stepVariableRegex = regexp.MustCompile(`\{\{\s*(?:(urlencode|json)\s+)?([\w\-]+)\s*\}\}`)
+
+// Runs the steps of a 'type: steps' check in order, e.g open the login page,
+// log in and open the account page. Values can be extracted from a response
+// and used in the steps after it, and cookies are kept between the steps.
+// The check stops at the first step that fails.
+func checkTransaction(uptimeRequest UptimeRequest, tokens *tokenSource) UptimeResponse {
+
+	var uptime UptimeResponse
+	uptime.Endpoint = uptimeRequest.Endpoint
+
+	// Each run starts without cookies, like a new visitor
+	jar, _ := cookiejar.New(nil)
+
+	variables := make(map[string]string)
+
+	for i, step := range uptimeRequest.Steps {
+
+		if len(step.Name) == 0 {
+			step.Name = "step " + strconv.Itoa(i+1)
+		}
+
+		// The steps use the options of the check, unless they set their own
+		if len(step.ExpectedStatus) == 0 {
+			step.ExpectedStatus = "2xx"
+		}
+		if len(step.RedirectPolicy) == 0 {
+			step.RedirectPolicy = uptimeRequest.RedirectPolicy
+		}
+		if len(step.Timeout) == 0 {
+			step.Timeout = uptimeRequest.Timeout
+		}
+
+		step = substituteVariables(step, variables)
+
+		// Each step has its own client for its timeout and redirects, the
+		// cookies are shared by all of them
+		client := newUptimeClient(step)
+		client.Jar = jar
+
+		stepUptime, headers, body := requestEndpoint(step, client, tokens)
+
+		result := StepResult{}
+		result.Name = step.Name
+		result.ResponseCode = stepUptime.ResponseCode
+		result.ResponseValue = stepUptime.ResponseValue
+		result.ResponseTime = stepUptime.ResponseTime
+		result.Timing = stepUptime.Timing
+		result.Up = stepUptime.Up
+
+		if result.Up {
+			if failed := extractVariables(step, headers, body, variables); len(failed) > 0 {
+				result.Up = false
+				result.ResponseValue = failed
+			}
+		}
+
+		uptime.Steps = append(uptime.Steps, result)
+		uptime.ResponseCode = result.ResponseCode
+		uptime.ResponseTime += result.ResponseTime
+		uptime.TokenUsed = stepUptime.TokenUsed
+		uptime.TokenError = stepUptime.TokenError
+
+		if !result.Up {
+			uptime.ResponseValue = "Step " + strconv.Itoa(i+1) + " (" + result.Name + ") failed: " + result.ResponseValue
+			return uptime
+		}
+
+		// The title of the last page is the one we show
+		if len(stepUptime.PageTitle) > 0 {
+			uptime.PageTitle = stepUptime.PageTitle
+		}
+	}
+
+	uptime.Up = true
+	return uptime
+}
+
+// Replaces the variables in the url, headers, body and assertions of a step
+func substituteVariables(step UptimeRequest, variables map[string]string) UptimeRequest {
+
+	replace := func(text string) string {
+		return stepVariableRegex.ReplaceAllStringFunc(text, func(match string) string {
+			parts := stepVariableRegex.FindStringSubmatch(match)
+			value, ok := variables[parts[2]]
+			if !ok {
+				return match
+			}
+
+			switch parts[1] {
+			case "urlencode":
+				return url.QueryEscape(value)
+			case "json":
+				// Without the quotes, they are in the body already
+				encoded, _ := json.Marshal(value)
+				return string(encoded[1 : len(encoded)-1])
+			}
+			return value
+		})
+	}
+
+	step.Endpoint = replace(step.Endpoint)
+	step.StatusCheck = replace(step.StatusCheck)
+	step.Body = replace(step.Body)
+	step.SearchFor = replace(step.SearchFor)
+
+	headers := make(map[string]string)
+	for name, value := range step.Headers {
+		headers[name] = replace(value)
+	}
+	step.Headers = headers
+
+	expectHeaders := make(map[string]string)
+	for name, value := range step.ExpectHeaders {
+		expectHeaders[name] = replace(value)
+	}
+	step.ExpectHeaders = expectHeaders
+
+	jsonPath := make(map[string]string)
+	for path, value := range step.JSONPath {
+		jsonPath[path] = replace(value)
+	}
+	step.JSONPath = jsonPath
+
+	return step
+}
+
+// Takes the values for the steps after this one from a response. A source
+// is 'json:$.path', 'header:Name' or 'regex:pattern', where the regex gives
+// its first group, or the whole match if it has none. Returns why an
+// extraction failed, or nothing.
+func extractVariables(step UptimeRequest, headers http.Header, body string, variables map[string]string) string {
+
+	for name, source := range step.Extract {
+
+		kind := source
+		expression := ""
+		if colon := strings.Index(source, ":"); colon > 0 {
+			kind = source[:colon]
+			expression = strings.TrimSpace(source[colon+1:])
+		}
+
+		value, found := "", false
+
+		switch strings.ToLower(kind) {
+		case "json":
+			var document interface{}
+			if err := json.Unmarshal([]byte(body), &document); err == nil {
+				if jsonValue, ok := jsonPathValue(document, expression); ok {
+					value, found = jsonValueString(jsonValue), true
+				}
+			}
+		case "header":
+			if headers != nil && len(headers.Get(expression)) > 0 {
+				value, found = headers.Get(expression), true
+			}
+		case "regex":
+			regex, err := regexp.Compile(expression)
+			if err != nil {
+				return "Invalid regex for " + name + ": " + err.Error()
+			}
+			if match := regex.FindStringSubmatch(body); match != nil {
+				value, found = match[0], true
+				if len(match) > 1 {
+					value = match[1]
+				}
+			}
+		default:
+			return "Unknown source for " + name + ": " + source
+		}
+
+		if !found {
+			return "Could not extract " + name + " with " + source
+		}
+
+		variables[name] = value
+	}
+
+	return ""
+}
@@ -0,0 +1,7 @@
+//go:build !go1.24
+
+package main
+
+// The grpc checks use the http/2 support of net/http that came with Go
+// 1.24. With an older Go, the build stops here with this name in the error.
+var _ = lorona_needs_go_1_24_or_newer
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Formats in log_formats.yaml can be written as grok expressions, like
+// '%{IPORHOST:ipaddress} - - \[%{HTTPDATE:timestamp}\]'. Before use, they
+// are compiled into a normal regex with named groups. These are the
+// standard patterns, they follow the logstash ones, rewritten where needed
+// for the go regex syntax. Users can add their own patterns in
+// log_formats.yaml, by using a name in capital letters.
+var grokStandardPatterns = map[string]string{
+	"USERNAME":       `[a-zA-Z0-9._-]+`,
+	"USER":           `%{USERNAME}`,
+	"EMAILLOCALPART": `[a-zA-Z0-9!#$%&'*+\-/=?^_{|}~]+(?:\.[a-zA-Z0-9!#$%&'*+\-/=?^_{|}~]+)*`,
+	"EMAILADDRESS":   `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":            `[+-]?\d+`,
+	"BASE10NUM":      `[+-]?(?:\d+(?:\.\d+)?|\.\d+)`,
+	"NUMBER":         `%{BASE10NUM}`,
+	"BASE16NUM":      `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":         `[1-9]\d*`,
+	"NONNEGINT":      `\d+`,
+	"WORD":           `\w+`,
+	"NOTSPACE":       `\S+`,
+	"SPACE":          `\s*`,
+	"DATA":           `.*?`,
+	"GREEDYDATA":     `.*`,
+	"QUOTEDSTRING":   `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"UUID":           `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+
+	// Networking
+	"MAC":      `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}`,
+	"IPV4":     `(?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)`,
+	"IPV6":     `(?:[A-Fa-f0-9]{0,4}:){2,7}[A-Fa-f0-9]{0,4}(?:%\w+)?`,
+	"IP":       `%{IPV6}|%{IPV4}`,
+	"HOSTNAME": `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?\b`,
+	"IPORHOST": `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	// Paths and urls
+	"PATH":         `%{UNIXPATH}|%{WINPATH}`,
+	"UNIXPATH":     `(?:/[\w_%!$@:.,+~-]*)+`,
+	"WINPATH":      `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+\-.]*`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	// Dates and times
+	"MONTH":             `\b(?:[Jj]an(?:uary|uar)?|[Ff]eb(?:ruary|ruar)?|[Mm](?:a|ä)?r(?:ch|z)?|[Aa]pr(?:il)?|[Mm]a(?:y|i)?|[Jj]un(?:e|i)?|[Jj]ul(?:y|i)?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo](?:c|k)?t(?:ober)?|[Nn]ov(?:ember)?|[Dd]e(?:c|z)(?:ember)?)\b`,
+	"MONTHNUM":          `0?[1-9]|1[0-2]`,
+	"MONTHDAY":          `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `\d\d(?:\d\d)?`,
+	"HOUR":              `2[0123]|[01]?[0-9]`,
+	"MINUTE":            `[0-5][0-9]`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?(?:%{ISO8601_TIMEZONE})?`,
+	"DATE":              `%{DATE_US}|%{DATE_EU}`,
+	"DATESTAMP":         `%{DATE}[- ]%{TIME}`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"NGINXERRORDATE":    `%{YEAR}/%{MONTHNUM}/%{MONTHDAY} %{TIME}`,
+
+	// Logs
+	"LOGLEVEL":          `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|[Ee]merg(?:ency)?|EMERG(?:ENCY)?`,
+	"SYSLOGPROG":        `%{PROG:program}(?:\[%{POSINT:pid}\])?`,
+	"PROG":              `[\x21-\x5a\x5c\x5e-\x7e]+`,
+	"SYSLOGHOST":        `%{IPORHOST}`,
+	"SYSLOGBASE":        `%{SYSLOGTIMESTAMP:timestamp} %{SYSLOGHOST:logsource} %{SYSLOGPROG}:`,
+	"HTTPDUSER":         `%{EMAILADDRESS}|%{USER}`,
+	"COMMONAPACHELOG":   `%{IPORHOST:clientip} %{HTTPDUSER:ident} %{HTTPDUSER:auth} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:verb} %{NOTSPACE:request}(?: HTTP/%{NUMBER:httpversion})?|%{DATA:rawrequest})" %{NUMBER:statuscode} (?:%{NUMBER:bytes}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QUOTEDSTRING:referrer} %{QUOTEDSTRING:agent}`,
+}
+
+// Matches %{NAME}, %{NAME:field} and %{NAME:field:type}. The type is
+// accepted for compatibility, lorona already converts numbers itself.
+var grokReferenceRegex = regexp.MustCompile(`%\{(\w+)(?::([\w.\-\[\]@]+))?(?::\w+)?\}`)
+
+// Characters that are not allowed in the name of a regex group
+var grokFieldNameRegex = regexp.MustCompile(`[^\w]`)
+
+// Patterns can refer to other patterns. This stops endless loops when
+// patterns refer to each other in a circle.
+const grokMaxDepth = 20
+
+// Returns true if the format is written as a grok expression
+func isGrokExpression(format string) bool {
+	return strings.Contains(format, "%{")
+}
+
+// Returns true if the key in log_formats.yaml is a user defined grok pattern
+func isGrokPatternName(name string) bool {
+	return len(name) > 0 && strings.ToUpper(name) == name && grokFieldNameRegex.FindString(name) == ""
+}
+
+// Compiles a grok expression into a regex with named groups. The user
+// patterns are checked first, so the standard ones can be overridden.
+func CompileGrok(expression string, userPatterns map[string]string) (string, error) {
+	return expandGrok(expression, userPatterns, 0)
+}
+
+func expandGrok(expression string, userPatterns map[string]string, depth int) (string, error) {
+
+	if depth > grokMaxDepth {
+		return "", errors.New("grok patterns are nested too deep, check for patterns that refer to each other")
+	}
+
+	var expandErr error
+
+	result := grokReferenceRegex.ReplaceAllStringFunc(expression, func(reference string) string {
+
+		parts := grokReferenceRegex.FindStringSubmatch(reference)
+		name := parts[1]
+		field := parts[2]
+
+		pattern, ok := userPatterns[name]
+		if !ok {
+			pattern, ok = grokStandardPatterns[name]
+		}
+
+		if !ok {
+			expandErr = errors.New("unknown grok pattern " + name)
+			return reference
+		}
+
+		expanded, err := expandGrok(pattern, userPatterns, depth+1)
+		if err != nil {
+			expandErr = err
+			return reference
+		}
+
+		if len(field) == 0 {
+			return "(?:" + expanded + ")"
+		}
+
+		return "(?P<" + grokFieldNameRegex.ReplaceAllString(field, "_") + ">" + expanded + ")"
+	})
+
+	if expandErr != nil {
+		return "", expandErr
+	}
+
+	return result, nil
+}
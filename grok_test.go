@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestCompileGrok(t *testing.T) {
+
+	userPatterns := map[string]string{
+		"REQUESTID": `req-%{INT}`,
+		"NUMBER":    `\d{3}`,
+	}
+
+	tests := []struct {
+		expression string
+		line       string
+		fields     map[string]string
+	}{
+		{
+			`%{IPORHOST:ipaddress} - - \[%{HTTPDATE:timestamp}\] "%{WORD:verb} %{NOTSPACE:request}"`,
+			`10.0.0.1 - - [01/May/2024:12:00:00 +0000] "GET /index.html"`,
+			map[string]string{"ipaddress": "10.0.0.1", "timestamp": "01/May/2024:12:00:00 +0000", "verb": "GET", "request": "/index.html"},
+		},
+		{
+			`%{LOGLEVEL:severity}: %{GREEDYDATA:description}`,
+			`WARNING: disk almost full`,
+			map[string]string{"severity": "WARNING", "description": "disk almost full"},
+		},
+		{
+			// Field names that are not allowed in a regex group are cleaned
+			`%{WORD:user.name} %{REQUESTID:request-id}`,
+			`mark req-123`,
+			map[string]string{"user_name": "mark", "request_id": "req-123"},
+		},
+		{
+			// The user patterns override the standard ones, the type is ignored
+			`%{NUMBER:code:int} %{INT:size}`,
+			`404 1234`,
+			map[string]string{"code": "404", "size": "1234"},
+		},
+	}
+
+	for _, test := range tests {
+
+		expression, err := CompileGrok(test.expression, userPatterns)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+			continue
+		}
+
+		regex, err := regexp.Compile("^" + expression + "$")
+		if err != nil {
+			t.Errorf("%s: compiled to an invalid regex: %v", test.expression, err)
+			continue
+		}
+
+		match := regex.FindStringSubmatch(test.line)
+		if match == nil {
+			t.Errorf("%s: does not match %q", test.expression, test.line)
+			continue
+		}
+
+		for i, name := range regex.SubexpNames() {
+			if expected, ok := test.fields[name]; ok && match[i] != expected {
+				t.Errorf("%s: field %s is %q, expected %q", test.expression, name, match[i], expected)
+			}
+		}
+	}
+}
+
+func TestCompileGrokErrors(t *testing.T) {
+
+	userPatterns := map[string]string{
+		"PING": `%{PONG}`,
+		"PONG": `%{PING}`,
+	}
+
+	for _, expression := range []string{`%{NOSUCHPATTERN:field}`, `%{PING}`} {
+		if _, err := CompileGrok(expression, userPatterns); err == nil {
+			t.Errorf("%s: expected an error", expression)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"strconv"
@@ -24,6 +25,10 @@ func itoa(i int64) string {
 	return strconv.FormatInt(i, 10)
 }
 
+func vtoa(v interface{}) string {
+	return fmt.Sprint(v)
+}
+
 func ttoa(t time.Time) string {
 	return t.Format(time.RFC850)
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"regexp"
+	"time"
+)
+
+// These parts of a description change from line to line, even when the
+// lines are about the same thing. We replace them with a placeholder to
+// get the template of the line. The order matters, e.g ips before numbers.
+var templateReplacements = []struct {
+	regex       *regexp.Regexp
+	placeholder string
+}{
+	{regexp.MustCompile(`"[^"]*"`), `"*"`},
+	{regexp.MustCompile(`'[^']*'`), `'*'`},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), "<uuid>"},
+	{regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(:\d+)?\b`), "<ip>"},
+	{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`), "<hex>"},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{16,}\b`), "<hex>"},
+	{regexp.MustCompile(`\d+`), "<num>"},
+}
+
+// Returns the description with all the changing parts replaced
+func lineTemplate(description string) string {
+	for _, replacement := range templateReplacements {
+		description = replacement.regex.ReplaceAllString(description, replacement.placeholder)
+	}
+	return description
+}
+
+// Adds a captured line to the results. If a line with the same template
+// from the same log was already added in this tick, we just count it on
+// that entry, so a repeated error does not flood the results. The first
+// line seen is kept as the example.
+// Returns true if the line was new in this tick.
+func AddLogLine(results *Results, logline LogLine) bool {
+
+	seen := logline.TimeStamp
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+
+	logline.Template = lineTemplate(logline.Description)
+	key := logline.LogPath + "|" + logline.Severity + "|" + logline.StatusCode + "|" + logline.Template
+
+	if i, ok := results.loglineIndex[key]; ok {
+		existing := &results.LoglineList[i]
+		existing.Count++
+
+		if seen.Before(existing.FirstSeen) {
+			existing.FirstSeen = seen
+		}
+		if seen.After(existing.LastSeen) {
+			existing.LastSeen = seen
+		}
+		return false
+	}
+
+	logline.Count = 1
+	logline.FirstSeen = seen
+	logline.LastSeen = seen
+
+	results.loglineIndex[key] = len(results.LoglineList)
+	results.LoglineList = append(results.LoglineList, logline)
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLineTemplate(t *testing.T) {
+
+	tests := []struct {
+		description string
+		template    string
+	}{
+		{"Timeout after 30 seconds", "Timeout after <num> seconds"},
+		{"Connection from 10.0.0.12:5432 refused", "Connection from <ip> refused"},
+		{"User 'mark' not found", "User '*' not found"},
+		{`Key "abc" expired`, `Key "*" expired`},
+		{"Job 3f2b6c1e-8a4d-4f7a-9c2e-1b2c3d4e5f60 failed", "Job <uuid> failed"},
+		{"Pointer 0x7ffe1234 is invalid", "Pointer <hex> is invalid"},
+	}
+
+	for _, test := range tests {
+		if template := lineTemplate(test.description); template != test.template {
+			t.Errorf("template of %q is %q, expected %q", test.description, template, test.template)
+		}
+	}
+}
+
+func TestAddLogLine(t *testing.T) {
+
+	var results Results
+	results.loglineIndex = make(map[string]int)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	lines := []LogLine{
+		{LogPath: "app.log", Severity: "error", Description: "Timeout after 30 seconds", TimeStamp: start.Add(time.Minute)},
+		{LogPath: "app.log", Severity: "error", Description: "Timeout after 45 seconds", TimeStamp: start},
+		{LogPath: "app.log", Severity: "error", Description: "Timeout after 12 seconds", TimeStamp: start.Add(2 * time.Minute)},
+		{LogPath: "app.log", Severity: "warning", Description: "Timeout after 30 seconds", TimeStamp: start},
+		{LogPath: "other.log", Severity: "error", Description: "Timeout after 30 seconds", TimeStamp: start},
+	}
+
+	expectedNew := []bool{true, false, false, true, true}
+	for i, logline := range lines {
+		if added := AddLogLine(&results, logline); added != expectedNew[i] {
+			t.Errorf("line %d was new %v, expected %v", i+1, added, expectedNew[i])
+		}
+	}
+
+	if len(results.LoglineList) != 3 {
+		t.Fatalf("%d entries, expected 3", len(results.LoglineList))
+	}
+
+	// The first line is kept as the example, with the times of all of them
+	entry := results.LoglineList[0]
+	if entry.Count != 3 {
+		t.Errorf("count is %d, expected 3", entry.Count)
+	}
+	if entry.Description != "Timeout after 30 seconds" {
+		t.Errorf("example is %q, expected the first line", entry.Description)
+	}
+	if !entry.FirstSeen.Equal(start) || !entry.LastSeen.Equal(start.Add(2*time.Minute)) {
+		t.Errorf("seen from %v to %v, expected %v to %v", entry.FirstSeen, entry.LastSeen, start, start.Add(2*time.Minute))
+	}
+
+	for _, entry := range results.LoglineList[1:] {
+		if entry.Count != 1 {
+			t.Errorf("%s %s: count is %d, expected 1", entry.LogPath, entry.Severity, entry.Count)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+// Keeps the lines around a captured line, so they can be sent along
+// with it. The lines before are kept in a small ring buffer, the lines
+// after are collected while the captured line waits to be forwarded.
+type lineContext struct {
+	before  int
+	after   int
+	recent  []string  // The last raw lines of the log, including the current one
+	pending []LogLine // Captured lines still waiting for lines after them
+}
+
+func newLineContext(before int, after int) *lineContext {
+	if before < 0 {
+		before = 0
+	}
+	if after < 0 {
+		after = 0
+	}
+	return &lineContext{before: before, after: after}
+}
+
+// Attaches the lines seen before the current one to the captured line
+func (context *lineContext) attachBefore(logline *LogLine) {
+	if context.before == 0 || len(context.recent) <= 1 {
+		return
+	}
+	logline.ContextBefore = append([]string{}, context.recent[:len(context.recent)-1]...)
+}
+
+// Must be called for each raw line in the log, before it is handled.
+// Returns the captured lines that now have all their lines after them.
+func (context *lineContext) addLine(text string) []LogLine {
+
+	var complete []LogLine
+
+	if len(context.pending) > 0 {
+		waiting := context.pending[:0]
+		for _, logline := range context.pending {
+			logline.ContextAfter = append(logline.ContextAfter, text)
+			if len(logline.ContextAfter) >= context.after {
+				complete = append(complete, logline)
+			} else {
+				waiting = append(waiting, logline)
+			}
+		}
+		context.pending = waiting
+	}
+
+	if context.before > 0 {
+		context.recent = append(context.recent, text)
+		if len(context.recent) > context.before+1 {
+			context.recent = context.recent[1:]
+		}
+	}
+
+	return complete
+}
+
+// Holds back a captured line until the lines after it come in. Returns
+// true if the line has to wait, false if it can be forwarded right away.
+func (context *lineContext) hold(logline LogLine) bool {
+	if context.after == 0 {
+		return false
+	}
+	context.pending = append(context.pending, logline)
+	return true
+}
+
+// Returns all captured lines still waiting, e.g at the end of the log
+func (context *lineContext) flush() []LogLine {
+	complete := context.pending
+	context.pending = nil
+	return complete
+}
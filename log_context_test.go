@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineContext(t *testing.T) {
+
+	context := newLineContext(2, 2)
+
+	lines := []string{"one", "two", "three", "four", "five", "six"}
+	var forwarded []LogLine
+
+	for _, text := range lines {
+
+		forwarded = append(forwarded, context.addLine(text)...)
+
+		// 'four' is the captured line
+		if text == "four" {
+			logline := LogLine{Description: text}
+			context.attachBefore(&logline)
+			if !context.hold(logline) {
+				t.Fatalf("line with lines after it was not held")
+			}
+		}
+	}
+
+	if len(forwarded) != 1 {
+		t.Fatalf("%d lines forwarded, expected 1", len(forwarded))
+	}
+	if expected := []string{"two", "three"}; !reflect.DeepEqual(forwarded[0].ContextBefore, expected) {
+		t.Errorf("lines before are %v, expected %v", forwarded[0].ContextBefore, expected)
+	}
+	if expected := []string{"five", "six"}; !reflect.DeepEqual(forwarded[0].ContextAfter, expected) {
+		t.Errorf("lines after are %v, expected %v", forwarded[0].ContextAfter, expected)
+	}
+}
+
+func TestLineContextFlush(t *testing.T) {
+
+	context := newLineContext(0, 3)
+	context.addLine("error")
+
+	logline := LogLine{Description: "error"}
+	context.attachBefore(&logline)
+	context.hold(logline)
+
+	if complete := context.addLine("next"); len(complete) != 0 {
+		t.Errorf("line forwarded before its lines after were complete")
+	}
+
+	// At the end of the log, the line goes on with the lines it has
+	complete := context.flush()
+	if len(complete) != 1 || !reflect.DeepEqual(complete[0].ContextAfter, []string{"next"}) {
+		t.Errorf("flush returned %v, expected the line with one line after it", complete)
+	}
+	if len(complete[0].ContextBefore) != 0 {
+		t.Errorf("lines before are %v, expected none", complete[0].ContextBefore)
+	}
+}
+
+func TestLineContextWithoutLinesAfter(t *testing.T) {
+
+	context := newLineContext(1, 0)
+	context.addLine("first")
+	context.addLine("second")
+
+	logline := LogLine{Description: "second"}
+	context.attachBefore(&logline)
+
+	if context.hold(logline) {
+		t.Errorf("line was held without lines after it")
+	}
+	if !reflect.DeepEqual(logline.ContextBefore, []string{"first"}) {
+		t.Errorf("lines before are %v, expected [first]", logline.ContextBefore)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// How many lines from the start of a log we use to detect its format
+const detectionSampleLines = 50
+
+// A format is only selected automatically if at least this share of the
+// sampled lines that look like log entries match it. Also at least this
+// share of all sampled lines must match, as multi-line entries, e.g stack
+// traces, have continuation lines that no format matches.
+const detectionMinimumScore = 0.8
+const detectionMinimumCoverage = 0.2
+
+// How well a single format from log_formats.yaml matches a log
+type FormatScore struct {
+	Name     string
+	Score    float64 // Share of the lines matched by any format that this one matched
+	Coverage float64 // Share of all sampled lines that matched
+	Fields   int     // Number of named fields the format extracts
+}
+
+// Reads the first lines of a log and scores them against every format in
+// the catalogue. The best matching format comes first. Entries that are not
+// regexes with named fields, like the timestamp formats, are skipped.
+func DetectLogFormat(filepath string, regexes map[string]string) ([]FormatScore, error) {
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() && len(lines) < detectionSampleLines {
+		if len(strings.TrimSpace(scanner.Text())) > 0 {
+			lines = append(lines, scanner.Text())
+		}
+	}
+
+	var scores []FormatScore
+	if len(lines) == 0 {
+		return scores, nil
+	}
+
+	// First we find which lines match which format
+	matches := make(map[string][]bool)
+	recognized := make([]bool, len(lines))
+	fields := make(map[string]int)
+
+	for name, regex := range regexes {
+
+		expression, err := regexp.Compile(regex)
+		if err != nil {
+			continue
+		}
+
+		for _, subexpName := range expression.SubexpNames() {
+			if len(subexpName) > 0 {
+				fields[name]++
+			}
+		}
+
+		if fields[name] == 0 {
+			continue
+		}
+
+		matches[name] = make([]bool, len(lines))
+		for i, line := range lines {
+			if expression.MatchString(line) {
+				matches[name][i] = true
+				recognized[i] = true
+			}
+		}
+	}
+
+	recognizedCount := 0
+	for _, r := range recognized {
+		if r {
+			recognizedCount++
+		}
+	}
+
+	// Lines that no format matches are likely continuation lines, so we
+	// score against the lines that look like log entries
+	for name, matched := range matches {
+
+		var score FormatScore
+		score.Name = name
+		score.Fields = fields[name]
+
+		matchedCount := 0
+		for _, m := range matched {
+			if m {
+				matchedCount++
+			}
+		}
+
+		if recognizedCount > 0 {
+			score.Score = float64(matchedCount) / float64(recognizedCount)
+		}
+		score.Coverage = float64(matchedCount) / float64(len(lines))
+		scores = append(scores, score)
+	}
+
+	// Best score first. If two formats match equally well, the one that
+	// extracts more fields is more useful
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		if scores[i].Fields != scores[j].Fields {
+			return scores[i].Fields > scores[j].Fields
+		}
+		return scores[i].Name < scores[j].Name
+	})
+
+	return scores, nil
+}
+
+// Picks the format for a log that has no usable type set. If the best format
+// matches well enough, it is returned, otherwise we only log a suggestion.
+func detectLogType(logFile *LogFile, regexes map[string]string) string {
+
+	scores, err := DetectLogFormat(logFile.Filepath, regexes)
+	if err != nil || len(scores) == 0 || scores[0].Score == 0 {
+		lLog.Print("Could not detect the format of " + logFile.Filepath)
+		return ""
+	}
+
+	best := scores[0]
+	percent := fmt.Sprintf("%.0f%%", best.Coverage*100)
+
+	if len(logFile.LogType) == 0 && best.Score >= detectionMinimumScore && best.Coverage >= detectionMinimumCoverage {
+		lLog.Print("Detected format " + best.Name + " for " + logFile.Filepath + " (" + percent + " of lines match)")
+		return best.Name
+	}
+
+	lLog.Print("Suggestion: set 'type: " + best.Name + "' for " + logFile.Filepath + " (" + percent + " of lines match)")
+	return ""
+}
+
+// Runs the detection for the files given on the command line and prints
+// the scores, e.g 'lorona detect /var/log/nginx/access.log'
+func RunDetectCommand(files []string) {
+
+	err, regexes := LoadLogFileRegex()
+	if err != nil {
+		fmt.Println("Cannot load log file regex: " + err.Error())
+		return
+	}
+
+	for _, file := range files {
+
+		scores, err := DetectLogFormat(file, regexes)
+		if err != nil {
+			fmt.Println(file + ": " + err.Error())
+			continue
+		}
+
+		fmt.Println(file + ":")
+		for _, score := range scores {
+			if score.Score > 0 {
+				fmt.Printf("  %-20s score %5.1f%%, %5.1f%% of lines match, %d fields\n", score.Name, score.Score*100, score.Coverage*100, score.Fields)
+			}
+		}
+
+		if len(scores) == 0 || scores[0].Score == 0 {
+			fmt.Println("  No known format matches")
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A single step in the processors list of a log. The steps run in order
+// on the fields taken from the line by the format regex, before the
+// capture conditions are evaluated. Which options are used depends on
+// the type, e.g:
+//
+//	processors:
+//	  - type: split
+//	    field: description
+//	    separator: " "
+//	    into: [method, path, protocol]
+//	  - type: convert
+//	    field: responsetime
+//	    to-type: float
+//	    multiply: 0.001 # milliseconds to seconds
+type LogProcessor struct {
+	Type          string            `yaml:"type"`           // rename, convert, split, kv-parse, add, drop, lowercase, trim or map-values
+	Field         string            `yaml:"field"`          // The field the step works on
+	Fields        []string          `yaml:"fields"`         // For drop and lowercase, to work on several fields at once
+	To            string            `yaml:"to"`             // rename: the new name of the field
+	ToType        string            `yaml:"to-type"`        // convert: int, float or string
+	Multiply      float64           `yaml:"multiply"`       // convert: multiplies the value, e.g to change units
+	Separator     string            `yaml:"separator"`      // split: between the parts, kv-parse: between the pairs
+	Into          []string          `yaml:"into"`           // split: the names of the fields for the parts
+	PairSeparator string            `yaml:"pair-separator"` // kv-parse: between key and value, '=' if not set
+	Prefix        string            `yaml:"prefix"`         // kv-parse: put in front of each key
+	Value         string            `yaml:"value"`          // add: the static value of the field
+	Mapping       map[string]string `yaml:"mapping"`        // map-values: old value to new value
+	Characters    string            `yaml:"characters"`     // trim: removed from both ends, spaces if not set
+}
+
+// Runs all the processors of a log on the fields of a line. Steps that
+// do not apply, e.g because the field does not exist, are skipped.
+func applyProcessors(processors []LogProcessor, fields map[string]interface{}) {
+
+	for _, processor := range processors {
+
+		switch strings.ToLower(processor.Type) {
+
+		case "rename":
+			if value, ok := fields[processor.Field]; ok && len(processor.To) > 0 {
+				delete(fields, processor.Field)
+				fields[processor.To] = value
+			}
+
+		case "convert":
+			if value, ok := fields[processor.Field]; ok {
+				fields[processor.Field] = convertValue(value, processor.ToType, processor.Multiply)
+			}
+
+		case "split":
+			if value, ok := fields[processor.Field]; ok {
+				separator := processor.Separator
+				if len(separator) == 0 {
+					separator = " "
+				}
+
+				parts := strings.SplitN(vtoa(value), separator, len(processor.Into))
+				for i, part := range parts {
+					if len(processor.Into[i]) > 0 {
+						fields[processor.Into[i]] = part
+					}
+				}
+			}
+
+		case "kv-parse":
+			if value, ok := fields[processor.Field]; ok {
+				parseKeyValues(vtoa(value), processor, fields)
+			}
+
+		case "add":
+			if len(processor.Field) > 0 {
+				fields[processor.Field] = processor.Value
+			}
+
+		case "drop":
+			for _, field := range processorFields(processor) {
+				delete(fields, field)
+			}
+
+		case "lowercase":
+			for _, field := range processorFields(processor) {
+				if value, ok := fields[field]; ok {
+					fields[field] = strings.ToLower(vtoa(value))
+				}
+			}
+
+		case "trim":
+			characters := processor.Characters
+			if len(characters) == 0 {
+				characters = " \t"
+			}
+			for _, field := range processorFields(processor) {
+				if value, ok := fields[field]; ok {
+					fields[field] = strings.Trim(vtoa(value), characters)
+				}
+			}
+
+		case "map-values":
+			if value, ok := fields[processor.Field]; ok {
+				if mapped, found := processor.Mapping[vtoa(value)]; found {
+					fields[processor.Field] = mapped
+				}
+			}
+
+		default:
+			lLog.Print("Unknown processor type: " + processor.Type)
+		}
+	}
+}
+
+// Returns all the fields a processor works on
+func processorFields(processor LogProcessor) []string {
+	if len(processor.Field) > 0 {
+		return append([]string{processor.Field}, processor.Fields...)
+	}
+	return processor.Fields
+}
+
+// Converts a value to the requested type. Values that cannot be
+// converted are left as they are.
+func convertValue(value interface{}, toType string, multiply float64) interface{} {
+
+	if multiply == 0 {
+		multiply = 1
+	}
+
+	switch strings.ToLower(toType) {
+	case "int":
+		if f, ok := toFloat64(value); ok {
+			return int64(f * multiply)
+		}
+	case "float", "":
+		if f, ok := toFloat64(value); ok {
+			return f * multiply
+		}
+	case "string":
+		return vtoa(value)
+	}
+
+	return value
+}
+
+// Splits a value like 'user=mark id=5' into fields. The separator
+// between the pairs defaults to a space, the one inside a pair to '='.
+func parseKeyValues(text string, processor LogProcessor, fields map[string]interface{}) {
+
+	separator := processor.Separator
+	if len(separator) == 0 {
+		separator = " "
+	}
+
+	pairSeparator := processor.PairSeparator
+	if len(pairSeparator) == 0 {
+		pairSeparator = "="
+	}
+
+	for _, pair := range strings.Split(text, separator) {
+		items := strings.SplitN(pair, pairSeparator, 2)
+		if len(items) == 2 && len(strings.TrimSpace(items[0])) > 0 {
+			fields[processor.Prefix+strings.TrimSpace(items[0])] = strings.Trim(strings.TrimSpace(items[1]), "\"")
+		}
+	}
+}
+
+// Returns the value as a float, if it is a number or a string that
+// holds a number
+func toFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyProcessors(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		processors []LogProcessor
+		fields     map[string]interface{}
+		expected   map[string]interface{}
+	}{
+		{
+			"rename",
+			[]LogProcessor{{Type: "rename", Field: "msg", To: "description"}, {Type: "rename", Field: "missing", To: "other"}},
+			map[string]interface{}{"msg": "hello"},
+			map[string]interface{}{"description": "hello"},
+		},
+		{
+			"convert",
+			[]LogProcessor{
+				{Type: "convert", Field: "duration", ToType: "float", Multiply: 1000},
+				{Type: "convert", Field: "bytes", ToType: "int"},
+				{Type: "convert", Field: "code", ToType: "string"},
+				{Type: "convert", Field: "text", ToType: "int"},
+			},
+			map[string]interface{}{"duration": "0.25", "bytes": "512", "code": int64(404), "text": "abc"},
+			map[string]interface{}{"duration": 250.0, "bytes": int64(512), "code": "404", "text": "abc"},
+		},
+		{
+			"split",
+			[]LogProcessor{{Type: "split", Field: "request", Into: []string{"method", "", "protocol"}}},
+			map[string]interface{}{"request": "GET /a b HTTP/1.1"},
+			map[string]interface{}{"request": "GET /a b HTTP/1.1", "method": "GET", "protocol": "b HTTP/1.1"},
+		},
+		{
+			"kv-parse",
+			[]LogProcessor{{Type: "kv-parse", Field: "extra", Separator: ",", PairSeparator: ":", Prefix: "kv_"}},
+			map[string]interface{}{"extra": `user: "mark", id:5,broken`},
+			map[string]interface{}{"extra": `user: "mark", id:5,broken`, "kv_user": "mark", "kv_id": "5"},
+		},
+		{
+			"add and drop",
+			[]LogProcessor{{Type: "add", Field: "env", Value: "prod"}, {Type: "drop", Field: "a", Fields: []string{"b"}}},
+			map[string]interface{}{"a": "1", "b": "2", "c": "3"},
+			map[string]interface{}{"c": "3", "env": "prod"},
+		},
+		{
+			"lowercase and map-values",
+			[]LogProcessor{
+				{Type: "lowercase", Fields: []string{"severity"}},
+				{Type: "map-values", Field: "severity", Mapping: map[string]string{"warn": "warning"}},
+			},
+			map[string]interface{}{"severity": "WARN"},
+			map[string]interface{}{"severity": "warning"},
+		},
+		{
+			"trim",
+			[]LogProcessor{{Type: "trim", Field: "request", Characters: `"`}, {Type: "trim", Fields: []string{"user"}}},
+			map[string]interface{}{"request": `"GET / HTTP/1.1"`, "user": " mark\t"},
+			map[string]interface{}{"request": "GET / HTTP/1.1", "user": "mark"},
+		},
+		{
+			"steps run in order",
+			[]LogProcessor{{Type: "rename", Field: "ms", To: "duration"}, {Type: "convert", Field: "duration", ToType: "int"}},
+			map[string]interface{}{"ms": "42"},
+			map[string]interface{}{"duration": int64(42)},
+		},
+	}
+
+	for _, test := range tests {
+		applyProcessors(test.processors, test.fields)
+		if !reflect.DeepEqual(test.fields, test.expected) {
+			t.Errorf("%s: fields are %v, expected %v", test.name, test.fields, test.expected)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Counts for each monitored log are kept here, keyed by the log path. The
+// counts are updated by the log monitoring threads before any sampling or
+// rate limiting is done, so the metrics stay accurate even when lines are
+// not forwarded to the main thread.
+var logSummaries = make(map[string]*LogSummary)
+var logSummariesMutex = &sync.Mutex{}
+
+// A simple token bucket. It allows up to 'rate' lines per second for
+// each log, with bursts of up to 'rate' lines.
+type lineRateLimiter struct {
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newLineRateLimiter(linesPerSecond int) *lineRateLimiter {
+	if linesPerSecond <= 0 {
+		return nil
+	}
+
+	return &lineRateLimiter{
+		rate:       float64(linesPerSecond),
+		tokens:     float64(linesPerSecond),
+		lastRefill: time.Now(),
+	}
+}
+
+// Returns true if one more line can pass through. A nil limiter means
+// there is no limit set for this log.
+func (limiter *lineRateLimiter) allow() bool {
+	if limiter == nil {
+		return true
+	}
+
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * limiter.rate
+	if limiter.tokens > limiter.rate {
+		limiter.tokens = limiter.rate
+	}
+	limiter.lastRefill = now
+
+	if limiter.tokens < 1 {
+		return false
+	}
+
+	limiter.tokens--
+	return true
+}
+
+// Decides if a line is kept, based on the sample rate for the log. A
+// sample rate of 1 keeps all lines, 0.1 keeps roughly every tenth line.
+func sampleLine(sampleRate float64) bool {
+	if sampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < sampleRate
+}
+
+// Returns the summary for a log. Must be called with the mutex held.
+func getLogSummary(logPath string) *LogSummary {
+	summary, ok := logSummaries[logPath]
+	if !ok {
+		summary = &LogSummary{}
+		summary.StatusCount = make(map[string]int64)
+		summary.SeverityLevelCount = make(map[string]int64)
+		logSummaries[logPath] = summary
+	}
+	return summary
+}
+
+// Counts a line that matched the capture conditions of its log
+func countMatchedLine(logline *LogLine) {
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	summary := getLogSummary(logline.LogPath)
+	summary.MatchedLines++
+	summary.StatusCount[logline.StatusCode]++
+
+	if len(logline.Severity) > 0 {
+		summary.SeverityLevelCount[logline.Severity]++
+	}
+}
+
+// Counts a line that was matched, but not passed on to the main thread.
+// Sampled lines were left out on purpose, dropped lines were over the
+// rate limit or the main thread was not keeping up.
+func countSkippedLine(logPath string, sampled bool) {
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	summary := getLogSummary(logPath)
+	if sampled {
+		summary.SampledLines++
+	} else {
+		summary.DroppedLines++
+	}
+}
+
+// Passes a matched line on to the main thread, unless it is sampled out
+// or over the rate limit. We never block here, if the channel is full, the
+// line is dropped so a burst of lines cannot stall the monitoring thread.
+func forwardLogLine(logFile *LogFile, limiter *lineRateLimiter, logline LogLine, loglines chan LogLine) {
+
+	countMatchedLine(&logline)
+
+	if !sampleLine(logFile.SampleRate) {
+		countSkippedLine(logline.LogPath, true)
+		return
+	}
+
+	if !limiter.allow() {
+		countSkippedLine(logline.LogPath, false)
+		return
+	}
+
+	select {
+	case loglines <- logline:
+	default:
+		countSkippedLine(logline.LogPath, false)
+	}
+}
+
+// Sorts the top lists of the summaries, like the ips that sent the most
+// attack lines. This is too slow to do for every line, so it runs once per
+// tick and the summaries keep the last lists in between.
+func UpdateTopCounts() {
+	updateTopAttackIPs()
+	updateTopAuthFailures()
+	updateTopSlowQueries()
+}
+
+func watchTopCounts() {
+	for {
+		time.Sleep(5 * time.Second)
+
+		if stopLogMonitoring == true {
+			return
+		}
+
+		UpdateTopCounts()
+	}
+}
+
+// Copies the current counts into the results structure. The top lists are
+// replaced and not changed by UpdateTopCounts, so they can be shared.
+func CopyLogSummaries(results *Results) {
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	for logPath, summary := range logSummaries {
+
+		summaryCopy := *summary
+		summaryCopy.StatusCount = make(map[string]int64)
+		summaryCopy.SeverityLevelCount = make(map[string]int64)
+
+		for k, v := range summary.StatusCount {
+			summaryCopy.StatusCount[k] = v
+		}
+
+		for k, v := range summary.SeverityLevelCount {
+			summaryCopy.SeverityLevelCount[k] = v
+		}
+
+		summaryCopy.UnparsedSamples = append([]string{}, summary.UnparsedSamples...)
+
+		if summary.AttackRuleHits != nil {
+			summaryCopy.AttackRuleHits = make(map[string]int64)
+			for k, v := range summary.AttackRuleHits {
+				summaryCopy.AttackRuleHits[k] = v
+			}
+		}
+
+		if summary.AuthEventCount != nil {
+			summaryCopy.AuthEventCount = make(map[string]int64)
+			for k, v := range summary.AuthEventCount {
+				summaryCopy.AuthEventCount[k] = v
+			}
+		}
+
+		results.LogSummary[logPath] = summaryCopy
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Starts watching a log for silence, if 'expect-activity-within' is set.
+// An application that stops writing to its log is often hung, so we raise
+// an event when the log has not been written to for too long, and again
+// when it is written to again.
+func startStalenessWatch(logFile LogFile) {
+
+	if len(logFile.ExpectActivityWithin) == 0 {
+		return
+	}
+
+	within, err := time.ParseDuration(logFile.ExpectActivityWithin)
+	if err != nil || within <= 0 {
+		lLog.Print("Could not parse expect-activity-within for " + logFile.Filepath + ": " + logFile.ExpectActivityWithin)
+		return
+	}
+
+	// We check a few times within the period, but not more than once a
+	// minute for long periods
+	checkInterval := within / 4
+	if checkInterval > time.Minute {
+		checkInterval = time.Minute
+	}
+	if checkInterval < time.Second {
+		checkInterval = time.Second
+	}
+
+	go watchStaleness(logFile.Filepath, within, checkInterval)
+}
+
+func watchStaleness(logPath string, within time.Duration, checkInterval time.Duration) {
+
+	for {
+		if stopLogMonitoring == true {
+			return
+		}
+
+		checkStaleness(logPath, within)
+
+		time.Sleep(checkInterval)
+	}
+}
+
+// Looks at when the log was last written to, and raises an event if this
+// is longer ago than allowed.
+func checkStaleness(logPath string, within time.Duration) {
+
+	fileStat, err := os.Stat(logPath)
+
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	summary := getLogSummary(logPath)
+
+	if err == nil {
+		summary.LastWriteTime = fileStat.ModTime()
+	}
+
+	// The last activity is the last write, or the last line we parsed if
+	// the file cannot be read, e.g while it is rotated
+	lastActivity := summary.LastWriteTime
+	if summary.LastParsedTime.After(lastActivity) {
+		lastActivity = summary.LastParsedTime
+	}
+
+	if lastActivity.IsZero() {
+		return
+	}
+
+	silence := time.Since(lastActivity)
+
+	if silence > within && !summary.Stale {
+		summary.Stale = true
+		RaiseEvent(logPath, "log-stale", "No activity in the log for "+silence.Round(time.Second).String(), true)
+	} else if silence <= within && summary.Stale {
+		summary.Stale = false
+		RaiseEvent(logPath, "log-stale", "Activity in the log resumed", false)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Knetic/govaluate"
+)
+
+// Matches window conditions in capture-line-if, e.g
+// count(int_statuscode >= 500) > 50 within 1m
+// distinct(ipaddress) > 100 within 5m
+var windowConditionRegex = regexp.MustCompile(`(?i)^\s*(count|distinct)\((.+)\)\s*(>=|<=|==|!=|>|<)\s*(\d+)\s+within\s+(\S+)\s*$`)
+
+// A single entry in the sliding window. For count() the value is
+// empty, for distinct() it is the value of the field.
+type windowEntry struct {
+	timeStamp time.Time
+	value     string
+}
+
+// A condition that is evaluated over all lines seen in a time window,
+// rather than on a single line.
+type windowCondition struct {
+	logPath    string
+	condition  string
+	function   string // count or distinct
+	argument   string // the expression for count, the field for distinct
+	expression *govaluate.EvaluableExpression
+	comparator string
+	threshold  int64
+	window     time.Duration
+	entries    []windowEntry    // In the order of their time
+	values     map[string]int64 // For distinct, how many entries have each value
+	firing     bool
+	mutex      sync.Mutex
+}
+
+// Values of all window conditions, keyed by log path and then condition
+var windowValues = make(map[string]map[string]int64)
+var windowValuesMutex = &sync.Mutex{}
+
+// Splits the conditions of a log into the normal per-line conditions and
+// the window conditions. Window conditions that cannot be parsed are
+// logged and left out.
+func parseWindowConditions(logPath string, conditions []string) ([]string, []*windowCondition) {
+
+	var lineConditions []string
+	var windows []*windowCondition
+
+	for _, condition := range conditions {
+
+		// Remove the 'then' part, it's not part of the conditional
+		plainCondition := condition
+		then_pos := strings.Index(strings.ToLower(condition), " then ")
+		if then_pos > 0 {
+			plainCondition = condition[0:then_pos]
+		}
+
+		match := windowConditionRegex.FindStringSubmatch(plainCondition)
+		if match == nil {
+			lineConditions = append(lineConditions, condition)
+			continue
+		}
+
+		window := &windowCondition{}
+		window.logPath = logPath
+		window.condition = strings.TrimSpace(plainCondition)
+		window.function = strings.ToLower(match[1])
+		window.argument = strings.TrimSpace(match[2])
+		window.comparator = match[3]
+		window.threshold, _ = strconv.ParseInt(match[4], 10, 64)
+
+		duration, err := time.ParseDuration(match[5])
+		if err != nil {
+			lLog.Print("Could not parse window duration in condition " + condition)
+			continue
+		}
+		window.window = duration
+		window.values = make(map[string]int64)
+
+		if window.function == "count" {
+			expression, err := govaluate.NewEvaluableExpression(window.argument)
+			if err != nil {
+				lLog.Print("Could not evaluate expression " + window.argument)
+				continue
+			}
+			window.expression = expression
+		}
+
+		windows = append(windows, window)
+	}
+
+	return lineConditions, windows
+}
+
+// Adds a parsed line to the window, if it is relevant for the condition,
+// and checks if the threshold was crossed. The line counts at the time it
+// was written, so the old lines read when lorona starts do not fill the
+// current window.
+func (window *windowCondition) addLine(parameters map[string]interface{}, lineTime time.Time) {
+
+	now := time.Now()
+	if lineTime.Before(now.Add(-window.window)) {
+		return
+	}
+
+	var entry windowEntry
+	entry.timeStamp = lineTime
+
+	if window.function == "count" {
+		result, err := window.expression.Evaluate(parameters)
+		if err != nil || result != true {
+			return
+		}
+	} else {
+		value, ok := parameters[window.argument]
+		if !ok {
+			return
+		}
+		entry.value = vtoa(value)
+	}
+
+	window.mutex.Lock()
+
+	// Entries are stamped with the time of their line, which is not always
+	// in order. Most lines are newer than all others, so we look for the
+	// place of the entry from the end.
+	i := len(window.entries)
+	for i > 0 && window.entries[i-1].timeStamp.After(entry.timeStamp) {
+		i--
+	}
+	window.entries = append(window.entries, windowEntry{})
+	copy(window.entries[i+1:], window.entries[i:])
+	window.entries[i] = entry
+
+	if window.function == "distinct" {
+		window.values[entry.value]++
+	}
+
+	window.mutex.Unlock()
+
+	window.evaluate(now)
+}
+
+// Drops entries that fell out of the window, computes the current value and
+// raises an event when the threshold is crossed or when it recovers. The
+// counts are kept up to date as entries come and go, so this does not look
+// at the entries that are still in the window.
+func (window *windowCondition) evaluate(now time.Time) {
+
+	window.mutex.Lock()
+	defer window.mutex.Unlock()
+
+	start := now.Add(-window.window)
+
+	first := 0
+	for first < len(window.entries) && window.entries[first].timeStamp.Before(start) {
+		if window.function == "distinct" {
+			value := window.entries[first].value
+			window.values[value]--
+			if window.values[value] <= 0 {
+				delete(window.values, value)
+			}
+		}
+		first++
+	}
+	window.entries = window.entries[first:]
+
+	var value int64
+	if window.function == "count" {
+		value = int64(len(window.entries))
+	} else {
+		value = int64(len(window.values))
+	}
+
+	setWindowValue(window.logPath, window.condition, value)
+
+	crossed := compareThreshold(value, window.comparator, window.threshold)
+
+	if crossed && !window.firing {
+		window.firing = true
+		RaiseEvent(window.logPath, window.condition, "Threshold crossed, value is "+itoa(value), true)
+	} else if !crossed && window.firing {
+		window.firing = false
+		RaiseEvent(window.logPath, window.condition, "Recovered, value is "+itoa(value), false)
+	}
+}
+
+// Re-evaluates the windows regularly, so we notice when a window recovers
+// even if no new lines come in.
+func watchWindows(windows []*windowCondition) {
+
+	if len(windows) == 0 {
+		return
+	}
+
+	for {
+		time.Sleep(5 * time.Second)
+
+		if stopLogMonitoring == true {
+			return
+		}
+
+		for _, window := range windows {
+			window.evaluate(time.Now())
+		}
+	}
+}
+
+func compareThreshold(value int64, comparator string, threshold int64) bool {
+	switch comparator {
+	case ">":
+		return value > threshold
+	case ">=":
+		return value >= threshold
+	case "<":
+		return value < threshold
+	case "<=":
+		return value <= threshold
+	case "==":
+		return value == threshold
+	case "!=":
+		return value != threshold
+	}
+	return false
+}
+
+func setWindowValue(logPath string, condition string, value int64) {
+	windowValuesMutex.Lock()
+	defer windowValuesMutex.Unlock()
+
+	if _, ok := windowValues[logPath]; !ok {
+		windowValues[logPath] = make(map[string]int64)
+	}
+	windowValues[logPath][condition] = value
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowConditions(t *testing.T) {
+
+	lineConditions, windows := parseWindowConditions("test-window.log", []string{
+		`severity == "error"`,
+		"count(int_statuscode >= 500) > 2 within 1m THEN alert immediately",
+		"distinct(ipaddress) >= 3 within 1m",
+	})
+
+	if len(lineConditions) != 1 || len(windows) != 2 {
+		t.Fatalf("%d line and %d window conditions, expected 1 and 2", len(lineConditions), len(windows))
+	}
+
+	count, distinct := windows[0], windows[1]
+	now := time.Now()
+
+	// Lines are not always in time order, and lines older than the window
+	// do not count
+	lines := []struct {
+		ip         string
+		statusCode int
+		age        time.Duration
+	}{
+		{"10.0.0.1", 500, 10 * time.Second},
+		{"10.0.0.2", 200, 40 * time.Second},
+		{"10.0.0.1", 503, 5 * time.Second},
+		{"10.0.0.3", 502, 2 * time.Minute},
+		{"10.0.0.2", 500, 50 * time.Second},
+	}
+
+	for _, line := range lines {
+		parameters := map[string]interface{}{"ipaddress": line.ip, "int_statuscode": line.statusCode}
+		count.addLine(parameters, now.Add(-line.age))
+		distinct.addLine(parameters, now.Add(-line.age))
+	}
+
+	for i := 1; i < len(count.entries); i++ {
+		if count.entries[i].timeStamp.Before(count.entries[i-1].timeStamp) {
+			t.Errorf("entries are not in time order")
+		}
+	}
+
+	tests := []struct {
+		after    time.Duration
+		count    int64
+		distinct int64
+		firing   bool
+	}{
+		{0, 3, 2, true},
+		{15 * time.Second, 2, 2, false}, // The entry of 50s ago is out of the window
+		{55 * time.Second, 1, 1, false},
+		{2 * time.Minute, 0, 0, false},
+	}
+
+	for _, test := range tests {
+
+		count.evaluate(now.Add(test.after))
+		distinct.evaluate(now.Add(test.after))
+
+		if value := windowValues["test-window.log"][count.condition]; value != test.count {
+			t.Errorf("after %v: count is %d, expected %d", test.after, value, test.count)
+		}
+		if value := windowValues["test-window.log"][distinct.condition]; value != test.distinct {
+			t.Errorf("after %v: distinct is %d, expected %d", test.after, value, test.distinct)
+		}
+		if count.firing != test.firing {
+			t.Errorf("after %v: count firing is %v, expected %v", test.after, count.firing, test.firing)
+		}
+		if distinct.firing {
+			t.Errorf("after %v: distinct is firing with fewer than 3 ips", test.after)
+		}
+	}
+
+	if len(distinct.values) != 0 || len(distinct.entries) != 0 {
+		t.Errorf("%d values and %d entries left after the window, expected none", len(distinct.values), len(distinct.entries))
+	}
+
+	for len(events) > 0 {
+		<-events
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// How many of the most recent unparsed lines we keep per log
+const unparsedSampleSize = 10
+
+// The parse ratio is checked on blocks of this many lines
+const parseRatioBlockSize = 100
+
+// A drop of the parse ratio by this much, compared to what we saw
+// before, means the format of the log has likely changed
+const parseRatioDropWarning = 0.3
+
+// The block of lines the parse ratio is checked on, and the ratio of the
+// blocks before it, per log. Only used with the logSummariesMutex held.
+type parseRatioBlock struct {
+	lines         int64
+	parsed        int64
+	baselineRatio float64
+	hasBaseline   bool
+}
+
+var parseRatioBlocks = make(map[string]*parseRatioBlock)
+
+// Counts a line of the log, and whether it matched the format regex. If
+// it did not match, it is kept as a sample, so users can see what the
+// lines that we do not understand look like.
+func countParsedLine(logPath string, text string, parsed bool) {
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	summary := getLogSummary(logPath)
+
+	block, ok := parseRatioBlocks[logPath]
+	if !ok {
+		block = &parseRatioBlock{}
+		parseRatioBlocks[logPath] = block
+	}
+
+	if parsed {
+		summary.ParsedLines++
+		summary.LastParsedTime = time.Now()
+		block.parsed++
+	} else {
+		summary.UnparsedLines++
+		summary.UnparsedSamples = append(summary.UnparsedSamples, text)
+		if len(summary.UnparsedSamples) > unparsedSampleSize {
+			summary.UnparsedSamples = summary.UnparsedSamples[1:]
+		}
+	}
+
+	block.lines++
+	if block.lines >= parseRatioBlockSize {
+		checkParseRatio(logPath, summary, block)
+	}
+}
+
+// Compares the parse ratio of the last block of lines with the ratio of
+// the blocks before it, and warns if it dropped sharply. Must be called
+// with the mutex held.
+func checkParseRatio(logPath string, summary *LogSummary, block *parseRatioBlock) {
+
+	blockRatio := float64(block.parsed) / float64(block.lines)
+	block.lines = 0
+	block.parsed = 0
+
+	// The first block gives us the ratio to compare against
+	if !block.hasBaseline {
+		block.baselineRatio = blockRatio
+		block.hasBaseline = true
+		return
+	}
+
+	if blockRatio < block.baselineRatio-parseRatioDropWarning {
+		if !summary.ParseRatioDropped {
+			summary.ParseRatioDropped = true
+			message := "Parse ratio dropped from " + strconv.FormatFloat(block.baselineRatio, 'f', 2, 64) +
+				" to " + strconv.FormatFloat(blockRatio, 'f', 2, 64) + ". Has the log format changed?"
+			lLog.Print("WARNING: " + logPath + ": " + message)
+			RaiseEvent(logPath, "parse-ratio-dropped", message, true)
+		}
+
+		// We do not move the baseline while the ratio is low, otherwise
+		// a broken format would soon become the new normal
+		return
+	}
+
+	if summary.ParseRatioDropped {
+		summary.ParseRatioDropped = false
+		RaiseEvent(logPath, "parse-ratio-dropped", "Parse ratio recovered to "+strconv.FormatFloat(blockRatio, 'f', 2, 64), false)
+	}
+
+	// Slowly follow the ratio, so the baseline reflects the recent past
+	block.baselineRatio = block.baselineRatio*0.8 + blockRatio*0.2
+}
+
+// Returns the share of lines that matched the format regex
+func (summary *LogSummary) ParseRatio() float64 {
+	total := summary.ParsedLines + summary.UnparsedLines
+	if total == 0 {
+		return 1
+	}
+	return float64(summary.ParsedLines) / float64(total)
+}
@@ -21,6 +21,11 @@ type Results struct {
 	LoglineList          []LogLine
 	BackupInfoList       []BackupInfo
 	LogSummary           map[string]LogSummary
+	EventList            []Event
+	BanList              []ClientBan
+	SLAList              []SLAReport
+
+	loglineIndex map[string]int // Finds the entry in LoglineList for a line template
 }
 
 // Let's go!
@@ -45,11 +50,39 @@ func main() {
 	// Start!
 	lLog.Print("Welcome to Lorona!")
 
+	// 'lorona detect <file>' shows which log formats match the given files
+	if flag.Arg(0) == "detect" {
+		RunDetectCommand(flag.Args()[1:])
+		return
+	}
+
+	// 'lorona pipe --type laravel-log' monitors the log written to stdin
+	var pipeOptions PipeOptions
+	if flag.Arg(0) == "pipe" {
+		pipeOptions = ParsePipeArgs(flag.Args()[1:], *settingsFilePtr)
+		*settingsFilePtr = pipeOptions.SettingsFile
+	}
+
 	settings, err := LoadSettings(*settingsFilePtr)
 	if err != nil {
 		lLog.Fatal().Err(err).Msg("Could not load settings file")
 	}
 
+	if flag.Arg(0) == "pipe" {
+		if err := AddPipeLog(settings, pipeOptions); err != nil {
+			lLog.Fatal().Err(err).Msg("Cannot monitor stdin")
+		}
+	}
+
+	// 'lorona sla-report --month 2024-05' writes the availability of the
+	// endpoints in that month
+	if flag.Arg(0) == "sla-report" {
+		if err := RunSLAReportCommand(settings, flag.Args()[1:]); err != nil {
+			lLog.Fatal().Err(err).Msg("Could not write SLA report")
+		}
+		return
+	}
+
 	lLog.Print("Lorona for package: " + settings.ContainerName + ". Settings File is " + *settingsFilePtr)
 
 	process(settings)
@@ -70,9 +103,16 @@ func process(settings *Settings) {
 
 	// Start all the monitoring services
 
+	// Load the past results of the uptime checks, for the availability
+	StartUptimeHistory(settings)
+
 	// Monitor specified endpoints to make sure they are up and running
 	StartEndpointMonitoring(settings, uptimes)
 
+	// Ban clients that send too many requests or errors. The log monitoring
+	// threads count the requests, so this has to be set up first
+	StartClientBans(settings)
+
 	// Monitor the specified log files and send the log lines to this thread
 	// for further processing
 	StartLogMonitoring(settings, loglines)
@@ -85,6 +125,12 @@ func process(settings *Settings) {
 
 	go PromPublish()
 
+	// Only in pipe mode do we stop when stdin ends. A nil channel never fires
+	var stdinDone chan bool
+	if pipeMode {
+		stdinDone = stdinClosed
+	}
+
 	// Watch for messages from the channels and add them to the results structure
 	// We need to handle the case that logs are filled faster than this function
 	// clears the results. Use extra timer / channel for this
@@ -93,20 +139,23 @@ func process(settings *Settings) {
 		select {
 		case logline := <-loglines:
 			// Add logline to the result. The logline contains enough info for it to later
-			// know which particular log it came from
-			var description = logline.Description
+			// know which particular log it came from. Repeated lines are only counted,
+			// so we only write the first one to our own log
+			if AddLogLine(&results, logline) {
+				var description = logline.Description
 
-			if len(logline.Description) > 19 {
-				logline.Description = logline.Description[0:20]
-			}
+				if len(description) > 19 {
+					description = description[0:20]
+				}
 
-			lLog.Print("Time: %s Error Level: %s Description: %s\n", logline.TimeStamp, logline.Severity, description)
-			results.LoglineList = append(results.LoglineList, logline)
+				lLog.Printf("Time: %s Error Level: %s Description: %s\n", logline.TimeStamp, logline.Severity, description)
+			}
 			UpdateMetrics(&results)
 		case uptime := <-uptimes:
 
 			// Add this new uptime result to the list
 			results.UptimeList = append(results.UptimeList, uptime)
+			RecordUptime(uptime)
 			// UpdateMetrics(&results)
 
 		case sysinfo := <-sysinfos:
@@ -117,6 +166,24 @@ func process(settings *Settings) {
 			results.BackupInfoList = append(results.BackupInfoList, backupInfo)
 			// UpdateMetrics(&results)
 
+		case event := <-events:
+			lLog.Print("Event from " + event.Source + ": " + event.Name + " - " + event.Message)
+			results.EventList = append(results.EventList, event)
+			UpdateMetrics(&results)
+
+		case <-stdinDone:
+			// The app writing to stdin exited. We take the lines still in
+			// the queue, write the results and stop with it
+			for len(loglines) > 0 {
+				AddLogLine(&results, <-loglines)
+			}
+			UpdateTopCounts()
+			UpdateMetrics(&results)
+
+			s, _ := json.Marshal(results)
+			lLog.Print(string(s))
+			return
+
 		case <-time.After(time.Second * 5): // does this do what we think it does? Check.
 		default:
 
@@ -139,6 +206,8 @@ func ResetResult(settings *Settings, results *Results) {
 	results.ContainerDescription = settings.ContainerDescription
 	results.UptimeList = []UptimeResponse{}
 	results.LoglineList = []LogLine{}
+	results.loglineIndex = make(map[string]int)
 	results.BackupInfoList = []BackupInfo{}
+	results.EventList = []Event{}
 	results.LogSummary = make(map[string]LogSummary)
 }
@@ -1,16 +1,50 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type UptimeRequest struct {
-	Endpoint       string `yaml:"url"`
-	StatusCheck    string `yaml:"status-check"`
-	ExpectedStatus string `yaml:"expected-status"`
-	CheckInterval  string `yaml:"check-interval"`
-	GetTokenUrl    string `yaml:"get-token_url"`
+	Endpoint         string            `yaml:"url"`
+	StatusCheck      string            `yaml:"status-check"`    // Called instead of the url, if set
+	ExpectedStatus   string            `yaml:"expected-status"` // e.g 200, 2xx, 200-299 or 200,301. 2xx if not set
+	CheckInterval    string            `yaml:"check-interval"`
+	GetTokenUrl      string            `yaml:"get-token_url"`      // Called for a bearer token, which is sent with the check
+	OAuth2           OAuth2Request     `yaml:"oauth2"`             // Gets the bearer token with the client credentials flow instead
+	Method           string            `yaml:"method"`             // HEAD if not set
+	Headers          map[string]string `yaml:"headers"`            // Sent with the request
+	Body             string            `yaml:"body"`               // Sent with the request, e.g for POST
+	Timeout          string            `yaml:"timeout"`            // 30s if not set
+	RedirectPolicy   string            `yaml:"redirect-policy"`    // follow, same-host or none. follow if not set
+	SearchFor        string            `yaml:"search-for"`         // Text the body must contain
+	SearchRegex      string            `yaml:"search-regex"`       // A regex the body must match
+	JSONPath         map[string]string `yaml:"json-path"`          // e.g $.status: ok. An empty value only checks that the path exists
+	ExpectHeaders    map[string]string `yaml:"expect-headers"`     // Text the response headers must contain
+	MaxBodySize      int64             `yaml:"max-body-size"`      // In bytes. Larger bodies fail the check
+	CertWarningDays  int64             `yaml:"cert-warning-days"`  // Warn when the certificate expires within this many days, 14 if not set
+	CertCriticalDays int64             `yaml:"cert-critical-days"` // 3 if not set
+	Type             string            `yaml:"type"`               // http, tcp, udp, dns, grpc or steps. http if not set
+	Send             string            `yaml:"send"`               // For tcp and udp, sent after connecting
+	Expect           string            `yaml:"expect"`             // For tcp and udp, text the answer must contain
+	DNSServer        string            `yaml:"dns-server"`         // For dns, the server to ask. The system resolver if not set
+	RecordType       string            `yaml:"record-type"`        // For dns, A, AAAA, CNAME, MX, NS or TXT. A if not set
+	ExpectRecords    []string          `yaml:"expect-records"`     // For dns, records that must be in the answer
+	GRPCService      string            `yaml:"grpc-service"`       // For grpc, the service to ask about. The whole server if not set
+	Steps            []UptimeRequest   `yaml:"steps"`              // For steps, the requests to make in order
+	Name             string            `yaml:"name"`               // For a step, shown when it fails
+	Extract          map[string]string `yaml:"extract"`            // For a step, values to use as {{name}} in the steps after it
+	FailAfter        int               `yaml:"fail-after"`         // Failed checks in a row before the endpoint is down, 1 if not set
+	RecoverAfter     int               `yaml:"recover-after"`      // Good checks in a row before the endpoint is up again, 1 if not set
+	Retries          int               `yaml:"retries"`            // Checks again right away this many times when a check fails
+	RetryDelay       string            `yaml:"retry-delay"`        // Between the retries, 1s if not set
+	FlapThreshold    int               `yaml:"flap-threshold"`     // Changes between good and failed within the flap window that make it flapping, 0 to not detect
+	FlapWindow       string            `yaml:"flap-window"`        // 1h if not set
+	SLO              float64           `yaml:"slo"`                // The availability we aim for, in percent, 99.9 if not set
 }
 
 // The UptimeResponse structure is used to record the results
@@ -21,6 +55,15 @@ type UptimeResponse struct {
 	ResponseCode  int
 	ResponseTime  time.Duration
 	PageTitle     string
+	Up            bool   // Set when the status is the expected one
+	TokenUsed     bool   // Set when the check was sent with a token
+	TokenError    string // Set when we could not get a token, the endpoint was not checked then
+	Timing        HTTPTiming
+	Certificate   *CertificateInfo `json:",omitempty"` // For https endpoints
+	Steps         []StepResult     `json:",omitempty"` // For transaction checks
+	Retries       int              // The retries it took, the result is the one of the last
+	State         string           // unknown, up, failing, down or recovering
+	Flapping      bool
 }
 
 // Used to stop the monitoring threads neatly
@@ -44,7 +87,7 @@ func StartEndpointMonitoring(settings *Settings, uptimes chan UptimeResponse) {
 			} else {
 
 				// Start the go-routine that will do the monitoring
-				go monitorEndpoint(uptimeRequest.Endpoint, duration, uptimes)
+				go monitorEndpoint(uptimeRequest, duration, uptimes)
 			}
 		}
 
@@ -57,27 +100,52 @@ func StopEndpointMonitoring() {
 }
 
 // A go-routine that regularly checks if an endpoint is up
-func monitorEndpoint(endpointUrl string, interval time.Duration, uptimes chan UptimeResponse) {
+func monitorEndpoint(uptimeRequest UptimeRequest, interval time.Duration, uptimes chan UptimeResponse) {
+
+	client := newUptimeClient(uptimeRequest)
+	tokens := newTokenSource(uptimeRequest, client)
+
+	state := newEndpointState(uptimeRequest)
+
+	retryDelay, err := time.ParseDuration(uptimeRequest.RetryDelay)
+	if err != nil || retryDelay < 0 {
+		retryDelay = time.Second
+	}
+
+	var certificate *CertificateInfo
+	var lastCertificateCheck time.Time
+	checksCertificate := strings.HasPrefix(strings.ToLower(uptimeRequest.checkUrl()), "https://")
 
 	for {
-		// A single uptime object that will store this uptime check results
-		var uptime UptimeResponse
-		uptime.Endpoint = endpointUrl
+		uptime := runCheck(uptimeRequest, client, tokens)
 
-		// Call the endpoint. Measure how long it takes
-		start := time.Now()
-		response, err := http.Head(uptime.Endpoint)
-		elapsed := time.Since(start)
+		// A single failure can be a hiccup, so we can check again right away
+		for uptime.Retries < uptimeRequest.Retries && !uptime.Up && len(uptime.TokenError) == 0 {
+			time.Sleep(retryDelay)
+			if stopEndpointMonitoring == true {
+				return
+			}
+			retries := uptime.Retries + 1
+			uptime = runCheck(uptimeRequest, client, tokens)
+			uptime.Retries = retries
+		}
 
-		if err != nil {
-			// We use code 598 for an error like 'host not found'
-			uptime.ResponseCode = 598
-			uptime.ResponseTime = elapsed
-			uptime.ResponseValue = err.Error()
-		} else {
-			uptime.ResponseCode = response.StatusCode
-			uptime.ResponseTime = elapsed
+		// Without a token we do not know if the endpoint is up
+		if len(uptime.TokenError) == 0 {
+			state.update(&uptime)
+		}
+
+		// Look at the certificate now and then. If we cannot connect, the
+		// check above failed too, and we try again next time
+		if checksCertificate && time.Since(lastCertificateCheck) >= certificateCheckInterval {
+			current, err := checkCertificate(uptimeRequest)
+			if err == nil {
+				raiseCertificateEvents(uptimeRequest.Endpoint, certificate, current)
+				certificate = current
+				lastCertificateCheck = time.Now()
+			}
 		}
+		uptime.Certificate = certificate
 
 		if stopEndpointMonitoring == true {
 			return
@@ -90,3 +158,195 @@ func monitorEndpoint(endpointUrl string, interval time.Duration, uptimes chan Up
 		time.Sleep(interval)
 	}
 }
+
+// Runs the check of the type of the endpoint once
+func runCheck(uptimeRequest UptimeRequest, client *http.Client, tokens *tokenSource) UptimeResponse {
+
+	switch uptimeRequest.Type {
+	case "", "http":
+		return checkEndpoint(uptimeRequest, client, tokens)
+	case "steps":
+		return checkTransaction(uptimeRequest, tokens)
+	case "grpc":
+		return checkGRPC(uptimeRequest, tokens)
+	}
+
+	return checkService(uptimeRequest)
+}
+
+// Creates the http client for an endpoint, with its timeout and redirect policy
+func newUptimeClient(uptimeRequest UptimeRequest) *http.Client {
+
+	// Each check opens a new connection, so the times include connecting
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+
+	client := &http.Client{Transport: transport}
+
+	client.Timeout = uptimeRequest.timeout()
+
+	switch uptimeRequest.RedirectPolicy {
+	case "none":
+		// We report the redirect itself, e.g 301
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	case "same-host":
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host != via[0].URL.Host {
+				return errors.New("redirected to another host: " + req.URL.Host)
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		}
+	}
+
+	return client
+}
+
+// Calls the endpoint once and records the result
+func checkEndpoint(uptimeRequest UptimeRequest, client *http.Client, tokens *tokenSource) UptimeResponse {
+	uptime, _, _ := requestEndpoint(uptimeRequest, client, tokens)
+	return uptime
+}
+
+// Does the work of checkEndpoint, and also returns the headers and body of
+// the response, for the steps of a transaction
+func requestEndpoint(uptimeRequest UptimeRequest, client *http.Client, tokens *tokenSource) (UptimeResponse, http.Header, string) {
+
+	// A single uptime object that will store this uptime check results
+	var uptime UptimeResponse
+	uptime.Endpoint = uptimeRequest.Endpoint
+
+	// We only need the body if there is something to check in it
+	method := strings.ToUpper(uptimeRequest.Method)
+	if len(method) == 0 && uptimeRequest.checksBody() {
+		method = http.MethodGet
+	} else if len(method) == 0 {
+		method = http.MethodHead
+	}
+
+	request, err := http.NewRequest(method, uptimeRequest.checkUrl(), strings.NewReader(uptimeRequest.Body))
+	if err != nil {
+		uptime.ResponseCode = 598
+		uptime.ResponseValue = err.Error()
+		return uptime, nil, ""
+	}
+
+	for name, value := range uptimeRequest.Headers {
+		request.Header.Set(name, value)
+	}
+
+	// Endpoints that need a token are not checked without one. This is
+	// reported apart, as it does not tell us if the endpoint is down
+	if tokens != nil {
+		token, err := tokens.get()
+		if err != nil {
+			uptime.TokenError = err.Error()
+			uptime.ResponseValue = "Could not get token: " + err.Error()
+			return uptime, nil, ""
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		uptime.TokenUsed = true
+	}
+
+	// Record how long each part of the request takes, so we can tell a slow
+	// network from a slow application
+	trace := newTimingTrace(&uptime.Timing)
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace.clientTrace()))
+
+	// Call the endpoint. Measure how long it takes
+	start := time.Now()
+	response, err := client.Do(request)
+	uptime.ResponseTime = time.Since(start)
+
+	if err != nil {
+		// We use code 598 for an error like 'host not found'
+		uptime.ResponseCode = 598
+		uptime.ResponseValue = err.Error()
+		return uptime, nil, ""
+	}
+	defer response.Body.Close()
+
+	uptime.ResponseCode = response.StatusCode
+
+	// The token was revoked or expired early, we get a new one next time
+	if tokens != nil && response.StatusCode == http.StatusUnauthorized {
+		tokens.invalidate()
+	}
+
+	uptime.Up = statusExpected(uptimeRequest.ExpectedStatus, response.StatusCode)
+
+	if !uptime.Up {
+		uptime.ResponseValue = "Expected status " + uptimeRequest.ExpectedStatus + ", got " + strconv.Itoa(response.StatusCode)
+		return uptime, response.Header, ""
+	}
+
+	body, err := readBody(response, uptimeRequest.MaxBodySize)
+	trace.bodyRead()
+	if err != nil {
+		uptime.Up = false
+		uptime.ResponseValue = err.Error()
+		return uptime, response.Header, ""
+	}
+
+	uptime.PageTitle = pageTitle(body)
+
+	// The first assertion that fails is reported
+	if failed := checkAssertions(uptimeRequest, response, body); len(failed) > 0 {
+		uptime.Up = false
+		uptime.ResponseValue = failed
+	}
+
+	return uptime, response.Header, body
+}
+
+// Returns the timeout of a check
+func (uptimeRequest UptimeRequest) timeout() time.Duration {
+	timeout, err := time.ParseDuration(uptimeRequest.Timeout)
+	if err != nil || timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return timeout
+}
+
+// Internal services may have a separate url that tells if they are up
+func (uptimeRequest UptimeRequest) checkUrl() string {
+	if len(uptimeRequest.StatusCheck) > 0 {
+		return uptimeRequest.StatusCheck
+	}
+	return uptimeRequest.Endpoint
+}
+
+// Checks a status code against the expected status from the settings. This
+// can be a code, a class like 2xx, a range like 200-299, or a list of these
+// separated by commas.
+func statusExpected(expected string, code int) bool {
+
+	if len(strings.TrimSpace(expected)) == 0 {
+		expected = "2xx"
+	}
+
+	for _, part := range strings.Split(expected, ",") {
+
+		part = strings.ToLower(strings.TrimSpace(part))
+
+		if len(part) == 3 && strings.HasSuffix(part, "xx") {
+			if class, err := strconv.Atoi(part[:1]); err == nil && code/100 == class {
+				return true
+			}
+		} else if dash := strings.Index(part, "-"); dash > 0 {
+			low, err1 := strconv.Atoi(strings.TrimSpace(part[:dash]))
+			high, err2 := strconv.Atoi(strings.TrimSpace(part[dash+1:]))
+			if err1 == nil && err2 == nil && code >= low && code <= high {
+				return true
+			}
+		} else if value, err := strconv.Atoi(part); err == nil && code == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestStatusExpected(t *testing.T) {
+
+	tests := []struct {
+		expected string
+		code     int
+		ok       bool
+	}{
+		{"", 200, true},
+		{"", 301, false},
+		{"200", 200, true},
+		{"200", 201, false},
+		{"2xx,304", 304, true},
+		{"2xx,304", 302, false},
+		{"2XX", 204, true},
+		{"4xx", 404, true},
+		{"200-299", 250, true},
+		{"200 - 299", 300, false},
+		{" 301 , 302 ", 302, true},
+		{"abc", 200, false},
+	}
+
+	for _, test := range tests {
+		if ok := statusExpected(test.expected, test.code); ok != test.ok {
+			t.Errorf("status %d with expected %q is %v, expected %v", test.code, test.expected, ok, test.ok)
+		}
+	}
+}
@@ -13,8 +13,25 @@ import (
 )
 
 type LogSummary struct {
-	StatusCount        map[string]int64
-	SeverityLevelCount map[string]int64
+	StatusCount         map[string]int64
+	SeverityLevelCount  map[string]int64
+	MatchedLines        int64 // Lines that matched the capture conditions
+	SampledLines        int64 // Matched lines left out by the sample rate
+	DroppedLines        int64 // Matched lines dropped by the rate limit or a full queue
+	ParsedLines         int64 // Lines that matched the format regex
+	UnparsedLines       int64 // Lines that did not match the format regex
+	UnparsedSamples     []string
+	ParseRatioDropped   bool // Set when the parse ratio dropped sharply
+	LastWriteTime       time.Time
+	LastParsedTime      time.Time
+	Stale               bool               // Set when the log was silent for longer than expected
+	AttackRuleHits      map[string]int64   // How often each attack rule matched
+	TopAttackIPs        []IPCount          // The ips that sent the most attack lines
+	AuthEventCount      map[string]int64   // How often each sshd and sudo event was seen
+	TopAuthFailureIPs   []AuthFailureCount // The ips with the most failed logins
+	TopAuthFailureUsers []AuthFailureCount // The users with the most failed logins
+	BruteForceSources   int64              // The ips and users over the failed login limit right now
+	TopSlowQueries      []SlowQueryStats   // The query fingerprints with the most total time, for MySQL slow logs
 }
 
 // A single line within a logfile
@@ -33,21 +50,47 @@ type LogLine struct {
 	ExecutionTime   uint64
 
 	Fields map[string]interface{}
+
+	// The ids of the web attack rules that matched this line
+	AttackRules []string `json:",omitempty"`
+
+	// Raw lines around this line in the log, if requested in the settings
+	ContextBefore []string `json:",omitempty"`
+	ContextAfter  []string `json:",omitempty"`
+
+	// Lines with the same template in a tick are collapsed into one entry
+	Template  string
+	Count     int64
+	FirstSeen time.Time
+	LastSeen  time.Time
 }
 
 // Represents a log file, e.g nginx.log
 type LogFile struct {
-	AppName           string   `yaml:"name"`
-	Filepath          string   `yaml:"filepath"`
-	AlertInterval     string   `yaml:"alert-interval"`
-	CaptureConditions []string `yaml:"capture-line-if"`
-	LogType           string   `yaml:"type"`
-	TimeFormatName    string   `yaml:"time-format"`
-	TimeFormat        string   // Loaded from log_formats.yaml file
-	Regex             string   // Loaded from log_formats.yaml file
-	LastTimestamp     string   // This is persisted in the lorona.dat file
-	LastByteRead      int64    // This is persisted in the lorona.dat file
-	LogFirstFewLines  string   // This is persisted in the lorona.dat file
+	AppName              string            `yaml:"name"`
+	Filepath             string            `yaml:"filepath"`
+	AlertInterval        string            `yaml:"alert-interval"`
+	CaptureConditions    []string          `yaml:"capture-line-if"`
+	LogType              string            `yaml:"type"`
+	TimeFormatName       string            `yaml:"time-format"`
+	TimeFormat           string            // Loaded from log_formats.yaml file
+	Regex                string            // Loaded from log_formats.yaml file
+	LastTimestamp        string            // This is persisted in the lorona.dat file
+	LastByteRead         int64             // This is persisted in the lorona.dat file
+	LogFirstFewLines     string            // This is persisted in the lorona.dat file
+	MaxLinesPerSecond    int               `yaml:"max-lines-per-second"`   // 0 means no limit
+	SampleRate           float64           `yaml:"sample-rate"`            // 0.1 means keep 1 in 10 captured lines
+	ContextBefore        int               `yaml:"context-before"`         // Raw lines before a captured line to send along
+	ContextAfter         int               `yaml:"context-after"`          // Raw lines after a captured line to send along
+	Processors           []LogProcessor    `yaml:"processors"`             // Steps run on the fields of each line, in order
+	SeverityMap          map[string]string `yaml:"severity-map"`           // Maps severities of this log to a canonical level, e.g E: error
+	ExpectActivityWithin string            `yaml:"expect-activity-within"` // Raise an event if the log is not written to for this long
+	DetectAttacks        bool              `yaml:"detect-attacks"`         // Check the lines against the web attack rules
+	TrackClients         bool              `yaml:"track-clients"`          // Count requests per client ip, for the client-bans settings
+	AuthMonitor          bool              `yaml:"auth-monitor"`           // Watch the sshd and sudo events, for auth.log
+	AuthMaxFailures      int               `yaml:"auth-max-failures"`      // Failed logins per ip or user within the window, 10 if not set
+	AuthWindow           string            `yaml:"auth-window"`            // The window for failed logins, 10m if not set
+	Passthrough          bool              `yaml:"passthrough"`            // For logs read from stdin, write the lines to stdout unchanged
 }
 
 // TODO:
@@ -69,6 +112,12 @@ func StartLogMonitoring(settings *Settings, loglines chan LogLine) {
 		panic("Cannot load log file regex")
 	}
 
+	// The rules for recognizing web attacks in access logs
+	attackRules = LoadAttackRules("./attack_rules.yaml")
+
+	// The logins seen in auth logs before
+	StartAuthMonitoring(settings)
+
 	for _, logFile := range settings.LogFiles {
 
 		// We get the parsing regex for this filetype from
@@ -78,16 +127,40 @@ func StartLogMonitoring(settings *Settings, loglines chan LogLine) {
 		logFile.Regex = regexes[logFile.LogType]
 		logFile.TimeFormat = regexes[logFile.TimeFormatName]
 
+		// If the type is not set or not known, we look at the start of the log
+		// to find a format that matches. If none matches well, we suggest the
+		// closest one in our log
+		if len(logFile.Regex) <= 0 && logFile.LogType != slowQueryLogType && logFile.Filepath != stdinLogPath {
+			detectedType := detectLogType(&logFile, regexes)
+			if len(detectedType) > 0 {
+				logFile.LogType = detectedType
+				logFile.Regex = regexes[detectedType]
+			}
+		}
+
 		// Make sure logtype is set. If it's not, no point parsing as we can't
 		// get the values anyways.
-		if len(logFile.Regex) <= 0 {
+		if len(logFile.Regex) <= 0 && logFile.LogType != slowQueryLogType {
 			lLog.Print("No LogType was specified for this log. Cannot monitor")
 			continue
 		}
 
 		// Start the go-routine that will be monitoring the logs
-		go monitorLog(logFile, loglines)
+		if logFile.Filepath == stdinLogPath {
+			if !pipeMode {
+				lLog.Print("The log " + logFile.AppName + " is read from stdin, it is only monitored with 'lorona pipe'")
+				continue
+			}
+			go monitorStdin(logFile, loglines)
+		} else {
+			go monitorLog(logFile, loglines)
+		}
+
+		// And the one that watches the log for silence
+		startStalenessWatch(logFile)
 	}
+
+	go watchTopCounts()
 }
 
 func StopReadingLogs() {
@@ -156,116 +229,302 @@ func monitorLog(logFile LogFile, loglines chan LogLine) {
 	scanner := bufio.NewScanner(f)
 	scanner.Split(bufio.ScanLines)
 
-	// Retrieve the regular expression we will use to parse the line
-	var expression = regexp.MustCompile(logFile.Regex)
+	parser := newLogParser(logFile, loglines)
 
 	// Loop through each line in the file
 	for scanner.Scan() {
+		parser.parseLine(scanner.Text())
+	}
 
-		// Structure where we will save the line
-		var logline LogLine
-		logline.Fields = make(map[string]interface{})
+	// The log ended, so the lines still waiting will not get more lines after them
+	parser.flush()
+}
 
-		// Get some info from the file itself
-		logline.LogPath = logFile.Filepath
-		logline.AppName = logFile.AppName
+// Parses the lines of a log and decides which are captured. Each log has
+// its own parser, as the windows, context and auth events are per log.
+type logParser struct {
+	logFile        LogFile
+	loglines       chan LogLine
+	expression     *regexp.Regexp
+	slowQueries    *slowQueryReader
+	limiter        *lineRateLimiter
+	lineConditions []string
+	windows        []*windowCondition
+	context        *lineContext
+	auth           *authMonitor
+}
 
-		// Find the matching text in the log
-		match := expression.FindStringSubmatch(scanner.Text())
-		if len(match) == 0 {
-			continue
-		}
+func newLogParser(logFile LogFile, loglines chan LogLine) *logParser {
 
-		// If set to true, this log line will not be added to the final log
-		var ignore_this_line = false
-
-		// This is where all the values for all the fields will be stored. This can be used
-		// for the evaluation of the condition if this particular line should be added to
-		// the log
-		condition_parameters := make(map[string]interface{}, 8)
-
-		// Get each value
-		for i, name := range expression.SubexpNames() {
-			if name == "severity" {
-				logline.Severity = match[i]
-			} else if name == "description" {
-				logline.Description = match[i]
-			} else if name == "timestamp" {
-
-				logline.TimeStampString = match[i]
-
-				if len(logFile.TimeFormat) > 0 {
-					t, err := time.Parse(logFile.TimeFormat, logline.TimeStampString)
-					if err == nil {
-						logline.TimeStamp = t
-					}
-				} else {
-					// We try a freestyle timestamp parsing
-					t, err := dateparse.ParseAny(logline.TimeStampString)
-					if err == nil {
-						logline.TimeStamp = t
-					}
-				}
-
-				condition_parameters["time_timestamp"] = logline.TimeStamp
-
-			} else if name == "statuscode" {
-				logline.StatusCode = match[i]
-				condition_parameters["int_statuscode"], _ = strconv.Atoi(match[i])
-			} else if name == "executiontime" {
-				condition_parameters["int_executiontime"], _ = strconv.Atoi(match[i])
-			} else if len(name) > 0 {
-				// One of the non-default keys came. We put it in the map
-				logline.Fields[name] = match[i]
-
-				// We also put int, float and time versions
-				if intVal, err := strconv.ParseInt(match[i], 10, 64); err == nil {
-					logline.Fields["int_"+name] = intVal
-				}
+	parser := &logParser{}
+	parser.logFile = logFile
+	parser.loglines = loglines
 
-			}
+	// Retrieve the regular expression we will use to parse the line. The
+	// entries of the MySQL slow log span several lines, so it has its own reader
+	if logFile.LogType == slowQueryLogType {
+		parser.slowQueries = newSlowQueryReader()
+	} else {
+		parser.expression = regexp.MustCompile(logFile.Regex)
+	}
+
+	// Limits how many captured lines per second we pass on to the main thread
+	parser.limiter = newLineRateLimiter(logFile.MaxLinesPerSecond)
+
+	// Conditions like 'count(int_statuscode >= 500) > 50 within 1m' are evaluated
+	// over a time window and not on a single line, so we keep them apart
+	// Conditions like 'severity >= warning' are changed to compare the rank of the level
+	conditions := rewriteSeverityConditions(logFile.CaptureConditions)
+	parser.lineConditions, parser.windows = parseWindowConditions(logFile.Filepath, conditions)
+	go watchWindows(parser.windows)
+
+	// Keeps the lines around captured lines
+	parser.context = newLineContext(logFile.ContextBefore, logFile.ContextAfter)
 
-			condition_parameters[name] = match[i]
+	// Watches the sshd and sudo events, if this is an auth log
+	parser.auth = newAuthMonitor(logFile)
+
+	return parser
+}
+
+// Parses a single line of the log
+func (parser *logParser) parseLine(text string) {
+
+	logFile := &parser.logFile
+
+	// Forward the captured lines that now have all the lines after them
+	for _, completeLine := range parser.context.addLine(text) {
+		forwardLogLine(logFile, parser.limiter, completeLine, parser.loglines)
+	}
+
+	// A slow log entry is complete when the next one starts
+	if parser.slowQueries != nil {
+		if values := parser.slowQueries.addLine(text); values != nil {
+			countParsedLine(logFile.Filepath, text, true)
+			parser.handleValues(values)
 		}
+		return
+	}
 
-		// We run the evaluator to figure out if we need to even add this line to the logs
-		// The user can specify conditions in the settings yaml file for when a log should
-		// be captured. We use a generic evaluator, which creates maximum flexibility for
-		// the user
+	// Find the matching text in the log. Lines we cannot parse are counted, so
+	// we notice when the format of the log changes
+	match := parser.expression.FindStringSubmatch(text)
+	countParsedLine(logFile.Filepath, text, len(match) > 0)
+	if len(match) == 0 {
+		return
+	}
 
-		for _, condition := range logFile.CaptureConditions {
+	// Take the values of all the named groups from the line
+	values := make(map[string]interface{})
+	for i, name := range parser.expression.SubexpNames() {
+		if len(name) > 0 {
+			values[name] = match[i]
+		}
+	}
 
-			ignore_this_line = true
-			// condition is something like "statuscode = 404" or "statuscode > 500 AND statuscode < 599 THEN alert immediately"
+	parser.handleValues(values)
+}
 
-			// First we remove the 'then' part as it's not part of the conditional
-			then_pos := strings.Index(strings.ToLower(condition), "then")
-			if then_pos > 0 {
-				then_part := condition[then_pos:len(condition)]
-				condition = condition[0 : then_pos-1] // remove the THEN part from condition
-				lLog.Print("Then condition not working yet " + then_part)
-			}
+// Turns the values of a parsed line into a LogLine, and forwards it if it
+// matches the capture conditions
+func (parser *logParser) handleValues(values map[string]interface{}) {
 
-			expression, err := govaluate.NewEvaluableExpression(condition)
-			if err != nil {
-				lLog.Print("Could not evaluate expression " + condition)
-				continue
+	logFile := &parser.logFile
+
+	// Structure where we will save the line
+	var logline LogLine
+	logline.Fields = make(map[string]interface{})
+
+	// Get some info from the file itself
+	logline.LogPath = logFile.Filepath
+	logline.AppName = logFile.AppName
+
+	// If set to true, this log line will not be added to the final log. A log
+	// with only window conditions captures no lines, it only raises events
+	var ignore_this_line = len(parser.lineConditions) == 0 && len(logFile.CaptureConditions) > 0
+
+	// This is where all the values for all the fields will be stored. This can be used
+	// for the evaluation of the condition if this particular line should be added to
+	// the log
+	condition_parameters := make(map[string]interface{}, 8)
+
+	// Run the processors of this log on the values
+	applyProcessors(logFile.Processors, values)
+
+	// For auth logs, add the sshd or sudo event the line is about
+	if parser.auth != nil {
+		parser.auth.handle(values, lineTime(parseLogTime(logFile, vtoa(values["timestamp"]))))
+	}
+
+	// For slow logs, add the times of the query to its fingerprint
+	if parser.slowQueries != nil {
+		countSlowQuery(logFile.Filepath, values)
+	}
+
+	// Get each value
+	for name, value := range values {
+		if name == "severity" {
+			// We use the canonical level, so all logs use the same names. The
+			// value from the log is kept in the fields, and conditions can use
+			// it as raw_severity
+			logline.Fields["raw_severity"] = value
+			condition_parameters["raw_severity"] = value
+			logline.Severity = normalizeSeverity(vtoa(value), logFile.SeverityMap)
+			value = logline.Severity
+
+			if rank := severityRank(logline.Severity); rank >= 0 {
+				condition_parameters["int_severity"] = rank
+			}
+		} else if name == "description" {
+			logline.Description = vtoa(value)
+		} else if name == "timestamp" {
+
+			logline.TimeStampString = vtoa(value)
+			logline.TimeStamp = parseLogTime(logFile, logline.TimeStampString)
+
+			condition_parameters["time_timestamp"] = logline.TimeStamp
+
+		} else if name == "statuscode" {
+			logline.StatusCode = vtoa(value)
+			condition_parameters["int_statuscode"], _ = strconv.Atoi(logline.StatusCode)
+		} else if name == "executiontime" {
+			if executionTime, ok := toFloat64(value); ok {
+				logline.ExecutionTime = uint64(executionTime)
+				condition_parameters["int_executiontime"] = int(executionTime)
 			}
+		} else {
+			// One of the non-default keys came. We put it in the map
+			logline.Fields[name] = value
 
-			// We have the parameters and their value, so we can now run the specified conditional
-			// to know if this line should be added or not
-			result, err := expression.Evaluate(condition_parameters)
-			// result is now set to "true", the bool value.
-			if err == nil && result == true {
-				ignore_this_line = false
-				break
+			// We also put int, float and time versions
+			if intVal, err := strconv.ParseInt(vtoa(value), 10, 64); err == nil {
+				logline.Fields["int_"+name] = intVal
 			}
+
 		}
 
-		if ignore_this_line == false {
-			loglines <- logline
+		condition_parameters[name] = value
+	}
+
+	// Tag the line with the web attack rules it matches. The rules can also
+	// be used in the conditions, e.g 'is_attack == true'
+	if logFile.DetectAttacks {
+		logline.AttackRules = matchAttackRules(values)
+		condition_parameters["attack_rules"] = joinRuleIDs(logline.AttackRules)
+		condition_parameters["is_attack"] = len(logline.AttackRules) > 0
+
+		if len(logline.AttackRules) > 0 {
+			countAttack(logFile.Filepath, logline.AttackRules, requestIP(values))
 		}
+	}
+
+	// Count the request for the client ip, it may get banned if it sends too many
+	if logFile.TrackClients {
+		clientBans.record(requestIP(values), logline.StatusCode, lineTime(logline.TimeStamp))
+	}
 
+	// Every parsed line counts towards the window conditions, whether
+	// it is captured or not
+	for _, window := range parser.windows {
+		window.addLine(condition_parameters, lineTime(logline.TimeStamp))
 	}
 
+	// We run the evaluator to figure out if we need to even add this line to the logs
+	// The user can specify conditions in the settings yaml file for when a log should
+	// be captured. We use a generic evaluator, which creates maximum flexibility for
+	// the user
+
+	for _, condition := range parser.lineConditions {
+
+		ignore_this_line = true
+		// condition is something like "statuscode = 404" or "statuscode > 500 AND statuscode < 599 THEN alert immediately"
+
+		// First we remove the 'then' part as it's not part of the conditional
+		then_pos := strings.Index(strings.ToLower(condition), "then")
+		if then_pos > 0 {
+			then_part := condition[then_pos:len(condition)]
+			condition = condition[0 : then_pos-1] // remove the THEN part from condition
+			lLog.Print("Then condition not working yet " + then_part)
+		}
+
+		expression, err := govaluate.NewEvaluableExpression(condition)
+		if err != nil {
+			lLog.Print("Could not evaluate expression " + condition)
+			continue
+		}
+
+		// We have the parameters and their value, so we can now run the specified conditional
+		// to know if this line should be added or not
+		result, err := expression.Evaluate(condition_parameters)
+		// result is now set to "true", the bool value.
+		if err == nil && result == true {
+			ignore_this_line = false
+			break
+		}
+	}
+
+	if ignore_this_line == false {
+		parser.context.attachBefore(&logline)
+		if !parser.context.hold(logline) {
+			forwardLogLine(logFile, parser.limiter, logline, parser.loglines)
+		}
+	}
+}
+
+// Parses the timestamp of a line, with the time format of the log if it has
+// one. Timestamps without a zone are in local time, and the ones without a
+// year, like in syslog, are from the last 12 months. Returns the zero time
+// if the timestamp cannot be parsed.
+func parseLogTime(logFile *LogFile, timeStamp string) time.Time {
+
+	var t time.Time
+	var err error
+
+	if len(logFile.TimeFormat) > 0 {
+		t, err = time.ParseInLocation(logFile.TimeFormat, timeStamp, time.Local)
+	} else {
+		// We try a freestyle timestamp parsing
+		t, err = dateparse.ParseIn(timeStamp, time.Local)
+	}
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	if t.Year() == 0 {
+		now := time.Now()
+		t = t.AddDate(now.Year(), 0, 0)
+		if t.After(now.Add(24 * time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+	}
+
+	return t
+}
+
+// The time a line was written, for the conditions and limits that count
+// lines within a time window. Lines without a timestamp, or with one in the
+// future, count as written now.
+func lineTime(timeStamp time.Time) time.Time {
+	now := time.Now()
+	if timeStamp.IsZero() || timeStamp.After(now) {
+		return now
+	}
+	return timeStamp
+}
+
+// Forwards the lines still waiting, e.g when the log ended
+func (parser *logParser) flush() {
+
+	if parser.slowQueries != nil {
+		if values := parser.slowQueries.flush(); values != nil {
+			countParsedLine(parser.logFile.Filepath, "", true)
+			parser.handleValues(values)
+		}
+	}
+
+	// The lines still waiting will not get more lines after them
+	for _, completeLine := range parser.context.flush() {
+		forwardLogLine(&parser.logFile, parser.limiter, completeLine, parser.loglines)
+	}
 }
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The log type for the MySQL slow query log. Its entries span several
+// lines, so it is not parsed with a regex from log_formats.yaml
+const slowQueryLogType = "mysql-slow-log"
+
+// How many fingerprints we list per log, most total time first
+const topSlowQueryCount = 20
+
+// We stop tracking new fingerprints per log after this many
+const maxTrackedSlowQueries = 1000
+
+// The longest query we keep, as sample or in the line
+const maxSlowQueryLength = 2000
+
+// All query fingerprints of the slow logs, with their times, per log
+var slowQueryStats = make(map[string]map[string]*SlowQueryStats)
+var slowQueryStatsMutex = &sync.Mutex{}
+
+// The times of all queries with the same fingerprint
+type SlowQueryStats struct {
+	ID           string // A short hash of the fingerprint, to use in labels
+	Fingerprint  string
+	Count        int64
+	TotalTime    float64 // Seconds
+	MaxTime      float64 // Seconds
+	TotalLock    float64 // Seconds
+	RowsExamined int64
+	Sample       string // The last query we saw with this fingerprint
+}
+
+// The header lines of an entry
+var slowTimeRegex = regexp.MustCompile(`^# Time: (.+)$`)
+var slowUserHostRegex = regexp.MustCompile(`^# User@Host: (\S*?)\[[^\]]*\] @ (\S*) \[([^\]]*)\]`)
+var slowQueryTimeRegex = regexp.MustCompile(`^# Query_time: ([\d.]+)\s+Lock_time: ([\d.]+)\s+Rows_sent: (\d+)\s+Rows_examined: (\d+)`)
+var slowSetTimestampRegex = regexp.MustCompile(`(?i)^SET timestamp=(\d+);$`)
+var slowUseRegex = regexp.MustCompile("(?i)^use `?([^`;]+)`?;$")
+
+// The lines mysqld writes to the log when it starts. They are not part of an entry
+var slowStartupRegex = regexp.MustCompile(`^(\S+, Version: |Tcp port: |Time\s+Id Command\s+Argument)`)
+
+// Used to turn a query into its fingerprint. Strings and comments are
+// found in one pass, whichever starts first wins, so a quote in a comment
+// like '-- don't cache' does not start a string, and a '#' in a string
+// does not start a comment.
+var sqlStringOrCommentRegex = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.|"")*"|(?s:/\*.*?\*/)|--[^\n]*|#[^\n]*`)
+var sqlNumberRegex = regexp.MustCompile(`\b(?:0x[0-9a-f]+|\d+(?:\.\d+)?(?:e[+-]?\d+)?)\b`)
+var sqlInListRegex = regexp.MustCompile(`\bin\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+var sqlValuesRegex = regexp.MustCompile(`\bvalues?\s*\([\s?,]*\)(?:\s*,\s*\([\s?,]*\))*`)
+var sqlSpaceRegex = regexp.MustCompile(`\s+`)
+
+// Puts the lines of the slow log together into entries
+type slowQueryReader struct {
+	values   map[string]interface{}
+	query    []string
+	database string
+}
+
+func newSlowQueryReader() *slowQueryReader {
+	return &slowQueryReader{}
+}
+
+// Adds a line of the log. When the line starts a new entry, the values of
+// the entry before it are returned.
+func (reader *slowQueryReader) addLine(text string) map[string]interface{} {
+
+	line := strings.TrimSpace(text)
+	if len(line) == 0 || slowStartupRegex.MatchString(line) {
+		return nil
+	}
+
+	var complete map[string]interface{}
+
+	if strings.HasPrefix(line, "#") {
+
+		// A header after the query means the next entry started
+		if len(reader.query) > 0 {
+			complete = reader.flush()
+		}
+
+		if reader.values == nil {
+			reader.values = make(map[string]interface{})
+		}
+
+		if match := slowTimeRegex.FindStringSubmatch(line); match != nil {
+			reader.values["timestamp"] = match[1]
+		} else if match := slowUserHostRegex.FindStringSubmatch(line); match != nil {
+			reader.values["user"] = match[1]
+			reader.values["host"] = match[2]
+			reader.values["ipaddress"] = match[3]
+		} else if match := slowQueryTimeRegex.FindStringSubmatch(line); match != nil {
+			reader.values["query_time"], _ = strconv.ParseFloat(match[1], 64)
+			reader.values["lock_time"], _ = strconv.ParseFloat(match[2], 64)
+			reader.values["rows_sent"], _ = strconv.ParseInt(match[3], 10, 64)
+			reader.values["rows_examined"], _ = strconv.ParseInt(match[4], 10, 64)
+		}
+
+		return complete
+	}
+
+	// The query, before the first header we cannot know what it belongs to
+	if reader.values == nil {
+		return nil
+	}
+
+	if match := slowSetTimestampRegex.FindStringSubmatch(line); match != nil {
+		// Entries within the same second have no '# Time' line
+		if _, ok := reader.values["timestamp"]; !ok {
+			seconds, _ := strconv.ParseInt(match[1], 10, 64)
+			reader.values["timestamp"] = time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+		}
+	} else if match := slowUseRegex.FindStringSubmatch(line); match != nil {
+		reader.database = match[1]
+	} else {
+		reader.query = append(reader.query, line)
+	}
+
+	return nil
+}
+
+// Returns the values of the entry being read, if it is complete
+func (reader *slowQueryReader) flush() map[string]interface{} {
+
+	values := reader.values
+
+	// A '--' or '#' comment ends at the end of its line, so the fingerprint
+	// is made from the lines as they were. The query we show is on one line
+	query := strings.Join(reader.query, "\n")
+
+	reader.values = nil
+	reader.query = nil
+
+	if values == nil || len(query) == 0 {
+		return nil
+	}
+
+	if _, ok := values["query_time"]; !ok {
+		return nil
+	}
+
+	if len(query) > maxSlowQueryLength {
+		query = query[:maxSlowQueryLength]
+	}
+
+	fingerprint := fingerprintQuery(query)
+	query = strings.Replace(query, "\n", " ", -1)
+
+	values["query"] = query
+	values["description"] = query
+	values["fingerprint"] = fingerprint
+	values["query_id"] = fingerprintID(fingerprint)
+
+	// The database stays selected for the next entries, until another 'use'
+	if len(reader.database) > 0 {
+		values["database"] = reader.database
+	}
+
+	return values
+}
+
+// Turns a query into its fingerprint, so queries that only differ in their
+// values are counted together, e.g 'select * from users where id = ?'
+func fingerprintQuery(query string) string {
+
+	fingerprint := sqlStringOrCommentRegex.ReplaceAllStringFunc(query, func(match string) string {
+		if match[0] == '\'' || match[0] == '"' {
+			return "?"
+		}
+		return " "
+	})
+	fingerprint = strings.ToLower(fingerprint)
+	fingerprint = sqlNumberRegex.ReplaceAllString(fingerprint, "?")
+	fingerprint = sqlInListRegex.ReplaceAllString(fingerprint, "in(?+)")
+	fingerprint = sqlValuesRegex.ReplaceAllString(fingerprint, "values(?+)")
+	fingerprint = sqlSpaceRegex.ReplaceAllString(fingerprint, " ")
+	fingerprint = strings.TrimSpace(fingerprint)
+	fingerprint = strings.TrimRight(fingerprint, "; ")
+
+	return fingerprint
+}
+
+func fingerprintID(fingerprint string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(fingerprint))
+	return strconv.FormatUint(hash.Sum64(), 16)
+}
+
+// Adds the times of a query to its fingerprint
+func countSlowQuery(logPath string, values map[string]interface{}) {
+
+	fingerprint, ok := values["fingerprint"].(string)
+	if !ok {
+		return
+	}
+
+	queryTime, _ := toFloat64(values["query_time"])
+	lockTime, _ := toFloat64(values["lock_time"])
+	rowsExamined, _ := toFloat64(values["rows_examined"])
+
+	slowQueryStatsMutex.Lock()
+	defer slowQueryStatsMutex.Unlock()
+
+	fingerprints, ok := slowQueryStats[logPath]
+	if !ok {
+		fingerprints = make(map[string]*SlowQueryStats)
+		slowQueryStats[logPath] = fingerprints
+	}
+
+	stats, ok := fingerprints[fingerprint]
+	if !ok {
+		if len(fingerprints) >= maxTrackedSlowQueries {
+			return
+		}
+		stats = &SlowQueryStats{ID: vtoa(values["query_id"]), Fingerprint: fingerprint}
+		fingerprints[fingerprint] = stats
+	}
+
+	stats.Count++
+	stats.TotalTime += queryTime
+	stats.TotalLock += lockTime
+	stats.RowsExamined += int64(rowsExamined)
+	stats.Sample = vtoa(values["query"])
+
+	if queryTime > stats.MaxTime {
+		stats.MaxTime = queryTime
+	}
+}
+
+// Puts the fingerprints with the most total time into the summaries, once
+// per tick
+func updateTopSlowQueries() {
+
+	slowQueryStatsMutex.Lock()
+	top := make(map[string][]SlowQueryStats)
+	for logPath, fingerprints := range slowQueryStats {
+		top[logPath] = topSlowQueries(fingerprints, topSlowQueryCount)
+	}
+	slowQueryStatsMutex.Unlock()
+
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	for logPath, queries := range top {
+		getLogSummary(logPath).TopSlowQueries = queries
+	}
+}
+
+// Returns the fingerprints with the most total time, most first
+func topSlowQueries(slowQueries map[string]*SlowQueryStats, limit int) []SlowQueryStats {
+
+	var top []SlowQueryStats
+	for _, stats := range slowQueries {
+		top = append(top, *stats)
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].TotalTime != top[j].TotalTime {
+			return top[i].TotalTime > top[j].TotalTime
+		}
+		return top[i].Fingerprint < top[j].Fingerprint
+	})
+
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	return top
+}
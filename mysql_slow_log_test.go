@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestFingerprintQuery(t *testing.T) {
+
+	tests := []struct {
+		query       string
+		fingerprint string
+	}{
+		{"SELECT * FROM users WHERE id = 5", "select * from users where id = ?"},
+		{"select * from t where name = 'bob' and x = \"y\"", "select * from t where name = ? and x = ?"},
+		{"select * from t where name = 'it''s # not a comment'", "select * from t where name = ?"},
+		{"select * from t where id in (1, 2, 3)", "select * from t where id in(?+)"},
+		{"INSERT INTO t (a, b) VALUES (1, 'x'), (2, 'y')", "insert into t (a, b) values(?+)"},
+		{"select /* hint */ 1;", "select ?"},
+		{"select *\n-- all columns\nfrom t where a = 1", "select * from t where a = ?"},
+		{"select 1 # one\nfrom dual", "select ? from dual"},
+		{"select * from t -- don't cache\nwhere name = 'bob'", "select * from t where name = ?"},
+		{"select * from t /* it's \"quoted\" */ where a = 'x' # isn't it\n", "select * from t where a = ?"},
+		{"select '-- not a comment', \"/* nor this */\" from t", "select ?, ? from t"},
+		{"select col1 from t2", "select col1 from t2"},
+		{"select  a\n\tfrom t ;", "select a from t"},
+	}
+
+	for _, test := range tests {
+		if fingerprint := fingerprintQuery(test.query); fingerprint != test.fingerprint {
+			t.Errorf("fingerprint of %q is %q, expected %q", test.query, fingerprint, test.fingerprint)
+		}
+	}
+}
+
+func TestSlowQueryReader(t *testing.T) {
+
+	lines := []string{
+		"/usr/sbin/mysqld, Version: 8.0.28 (MySQL Community Server - GPL). started with:",
+		"# Time: 2022-03-01T10:00:01.123456Z",
+		"# User@Host: shop[shop] @ localhost [127.0.0.1]  Id:    42",
+		"# Query_time: 12.345678  Lock_time: 0.000120 Rows_sent: 1  Rows_examined: 500000",
+		"use shop;",
+		"SET timestamp=1646128801;",
+		"SELECT * FROM orders -- open orders only",
+		"WHERE customer_id = 123 AND status = 'open';",
+		"# Time: 2022-03-01T10:00:05.000000Z",
+	}
+
+	reader := newSlowQueryReader()
+
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		if values := reader.addLine(line); values != nil {
+			entries = append(entries, values)
+		}
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, expected 1", len(entries))
+	}
+	values := entries[0]
+
+	// The comment only hides the rest of its own line
+	if fingerprint := vtoa(values["fingerprint"]); fingerprint != "select * from orders where customer_id = ? and status = ?" {
+		t.Errorf("fingerprint is %q", fingerprint)
+	}
+
+	if query := vtoa(values["query"]); query != "SELECT * FROM orders -- open orders only WHERE customer_id = 123 AND status = 'open';" {
+		t.Errorf("query is %q", query)
+	}
+
+	if values["query_time"] != 12.345678 || values["rows_examined"] != int64(500000) || values["ipaddress"] != "127.0.0.1" {
+		t.Errorf("header values are %v", values)
+	}
+}
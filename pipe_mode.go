@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strings"
+)
+
+// Logs with this filepath are read from stdin, e.g with
+// 'myapp 2>&1 | lorona pipe --type laravel-log'
+const stdinLogPath = "-"
+
+// Closed when stdin ends, so lorona stops with the app that writes to it
+var stdinClosed = make(chan bool)
+
+// Only 'lorona pipe' reads stdin. When lorona runs as a daemon, stdin is
+// empty or closed, so the log with 'filepath: -' is left out
+var pipeMode = false
+
+// The options of 'lorona pipe'
+type PipeOptions struct {
+	SettingsFile string
+	LogType      string
+	AppName      string
+	Passthrough  bool
+}
+
+// Parses the arguments after 'pipe'. The settings file can be given before
+// or after 'pipe', so the one from the main arguments is the default.
+func ParsePipeArgs(args []string, settingsFile string) PipeOptions {
+
+	var options PipeOptions
+
+	flags := flag.NewFlagSet("pipe", flag.ExitOnError)
+	flags.StringVar(&options.SettingsFile, "settings", settingsFile, "Location of the settings file")
+	flags.StringVar(&options.LogType, "type", "", "The type of the log, as in log_formats.yaml")
+	flags.StringVar(&options.AppName, "name", "stdin", "The name of the app writing the log")
+	flags.BoolVar(&options.Passthrough, "passthrough", false, "Write the lines to stdout unchanged")
+	flags.Parse(args)
+
+	return options
+}
+
+// Adds the log that is read from stdin to the settings. If the settings
+// already have a log with 'filepath: -', its conditions and other options
+// are used, otherwise all lines are captured. The format of stdin cannot be
+// detected before reading it, so without a known type we stop right away
+// instead of waiting for lines we cannot parse.
+func AddPipeLog(settings *Settings, options PipeOptions) error {
+
+	index := -1
+	for i, logFile := range settings.LogFiles {
+		if logFile.Filepath == stdinLogPath {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		var logFile LogFile
+		logFile.AppName = options.AppName
+		logFile.Filepath = stdinLogPath
+		logFile.SampleRate = 1
+		settings.LogFiles = append(settings.LogFiles, logFile)
+		index = len(settings.LogFiles) - 1
+	}
+
+	logFile := &settings.LogFiles[index]
+
+	if len(options.LogType) > 0 {
+		logFile.LogType = options.LogType
+	}
+
+	if options.Passthrough {
+		logFile.Passthrough = true
+	}
+
+	if len(logFile.LogType) == 0 {
+		return errors.New("The type of the log on stdin is not known. Use --type or set the type of the log with filepath '-'")
+	}
+
+	if logFile.LogType == slowQueryLogType {
+		pipeMode = true
+		return nil
+	}
+
+	err, regexes := LoadLogFileRegex()
+	if err != nil {
+		return err
+	}
+
+	// Allow 'laravel' for 'laravel-log'
+	if len(regexes[logFile.LogType]) == 0 && len(regexes[logFile.LogType+"-log"]) > 0 {
+		logFile.LogType += "-log"
+	}
+
+	if len(regexes[logFile.LogType]) == 0 {
+		return errors.New("Unknown log type " + logFile.LogType + ", it is not in log_formats.yaml")
+	}
+
+	pipeMode = true
+	return nil
+}
+
+// Reads the log from stdin until it ends. The lines go through the same
+// parsing, conditions and metrics as the lines of a log file.
+func monitorStdin(logFile LogFile, loglines chan LogLine) {
+
+	reader := bufio.NewReader(os.Stdin)
+	parser := newLogParser(logFile, loglines)
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if len(line) > 0 {
+
+			// The line goes on unchanged, so lorona can sit in the
+			// middle of a pipe
+			if logFile.Passthrough {
+				os.Stdout.WriteString(line)
+			}
+
+			parser.parseLine(strings.TrimRight(line, "\r\n"))
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				lLog.Print("Could not read from stdin: " + err.Error())
+			}
+			break
+		}
+	}
+
+	// Stdin ended, so the lines still waiting will not get more lines after them
+	parser.flush()
+
+	lLog.Print("Stdin was closed")
+	close(stdinClosed)
+}
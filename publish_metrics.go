@@ -4,6 +4,7 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -29,14 +30,60 @@ var driveSpace = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_hd_avai
 
 // Endpoint monitoring
 var endpointAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_up", Help: "1 or 0, depending on if the endpoint is up or not"}, []string{"urls"})
+var endpointPhaseDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_phase_duration", Help: "How long each part of the check took: dns, connect, tls, first_byte and transfer"}, []string{"urls", "phase"})
+var endpointStepUp = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_step_up", Help: "1 or 0, depending on if the step of a transaction check passed"}, []string{"urls", "step"})
+var endpointStepDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_step_duration", Help: "How long the step of a transaction check took"}, []string{"urls", "step"})
+var endpointCheckOk = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_check_ok", Help: "1 or 0, depending on if the last check of the endpoint passed"}, []string{"urls"})
+var endpointStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_state", Help: "1 for the state the endpoint is in: unknown, up, failing, down or recovering"}, []string{"urls", "state"})
+var endpointFlapping = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_flapping", Help: "1 or 0, depending on if the endpoint changes between up and down too often"}, []string{"urls"})
+var endpointRetries = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_retries", Help: "The retries the last check of the endpoint took"}, []string{"urls"})
+var endpointTokenOk = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_token_ok", Help: "1 or 0, depending on if we could get the token for the endpoint"}, []string{"urls"})
+var endpointCertDaysLeft = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_cert_days_left", Help: "Days until the certificate of the endpoint expires"}, []string{"urls"})
+var endpointCertValid = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_cert_valid", Help: "1 or 0, depending on if the certificate chain verifies and covers the host"}, []string{"urls"})
+var endpointCertInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_cert_info", Help: "Always 1, the labels describe the certificate of the endpoint"}, []string{"urls", "subject", "issuer"})
+var endpointAvailability = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_availability", Help: "The share of the time the endpoint was up within the window: 24h, 7d or 30d"}, []string{"urls", "window"})
+var endpointIncidents = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_incidents", Help: "The times the endpoint went down within the window: 24h, 7d or 30d"}, []string{"urls", "window"})
+var endpointErrorBudget = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_error_budget_remaining", Help: "The share of the downtime the SLO allows in 30 days that is left"}, []string{"urls"})
 var endpointDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_endpoint_duration", Help: "Informs how long it took for the endpoint to respond"}, []string{"urls"})
 
+// The subject and issuer the cert info of each endpoint was last set with, so
+// the series of a certificate is removed when it is replaced
+var endpointCertLabels = make(map[string][2]string)
+
 // Backups monitoring
 var backupInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_backup_info", Help: "1 or 0, depending on if a backup was done or not"}, []string{"backup_directory", "backup_in_last_24_hours", "last_backup_size", "last_backup_time", "last_backup_file"})
 
 // Logs monitoring
 var statusCodes = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_status_codes", Help: "A guage for each status_code, showing its count"}, []string{"log_path", "status_code"})
 var severity = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_severity", Help: "A gauge for each severity, showing its count"}, []string{"log_path", "severity"})
+var logLinesMatched = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_lines_matched", Help: "The number of lines that matched the capture conditions"}, []string{"log_path"})
+var logLinesSampled = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_lines_sampled", Help: "The number of matched lines left out by the sample rate"}, []string{"log_path"})
+var logLinesDropped = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_lines_dropped", Help: "The number of matched lines dropped by the rate limit or because the queue to the main thread was full"}, []string{"log_path"})
+var logLinesUnparsed = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_lines_unparsed", Help: "The number of lines that did not match the log format"}, []string{"log_path"})
+var logParseRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_parse_success_ratio", Help: "The share of lines that matched the log format, between 0 and 1"}, []string{"log_path"})
+var logStale = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_stale", Help: "1 or 0, depending on if the log was silent for longer than expected"}, []string{"log_path"})
+var logSecondsSinceWrite = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_seconds_since_write", Help: "The number of seconds since the log was last written to"}, []string{"log_path"})
+var logWindowValue = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_log_window_value", Help: "The current value of a windowed capture condition"}, []string{"log_path", "condition"})
+
+// Web attacks
+var attackRuleHits = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_attack_rule_hits", Help: "How often each web attack rule matched"}, []string{"log_path", "rule"})
+var attackTopIPs = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_attack_top_ips", Help: "The number of attack lines sent by the top offending ips"}, []string{"log_path", "ip"})
+
+// Auth logs
+var authEvents = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_auth_events", Help: "How often each sshd and sudo event was seen"}, []string{"log_path", "event"})
+var authFailuresByIP = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_auth_failures_by_ip", Help: "Failed logins of the ips with the most failed logins"}, []string{"log_path", "ip"})
+var authBruteForceSources = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_auth_brute_force_sources", Help: "The number of ips and users over the failed login limit"}, []string{"log_path"})
+
+// MySQL slow logs
+var slowQueryCount = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_mysql_slow_query_count", Help: "How often a query fingerprint was in the slow log"}, []string{"log_path", "query_id", "fingerprint"})
+var slowQueryTimeTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_mysql_slow_query_seconds_total", Help: "The total time of the queries with a fingerprint"}, []string{"log_path", "query_id", "fingerprint"})
+var slowQueryTimeMax = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_mysql_slow_query_seconds_max", Help: "The longest time of a query with a fingerprint"}, []string{"log_path", "query_id", "fingerprint"})
+
+// Client bans
+var bannedClients = promauto.NewGauge(prometheus.GaugeOpts{Name: "lorona_banned_clients", Help: "The number of client ips that are currently banned"})
+
+// Events
+var eventFiring = promauto.NewGaugeVec(prometheus.GaugeOpts{Name: "lorona_event_firing", Help: "1 or 0, depending on if the event is currently firing"}, []string{"source", "name"})
 
 // To be called by mainthread anytime there is something new to
 // share with prometheus
@@ -75,13 +122,61 @@ func UpdateMetrics(result *Results) {
 	// Publish endpoints being monitored
 	for _, uptimeResponse := range result.UptimeList {
 
-		if uptimeResponse.ResponseCode == 200 {
+		// The certificate is looked at apart from the check
+		if uptimeResponse.Certificate != nil {
+			certificate := uptimeResponse.Certificate
+			endpointCertDaysLeft.WithLabelValues(uptimeResponse.Endpoint).Set(float64(certificate.DaysLeft))
+			endpointCertValid.WithLabelValues(uptimeResponse.Endpoint).Set(btof(certificate.valid()))
+			labels := [2]string{certificate.Subject, certificate.Issuer}
+			if last, ok := endpointCertLabels[uptimeResponse.Endpoint]; ok && last != labels {
+				endpointCertInfo.DeleteLabelValues(uptimeResponse.Endpoint, last[0], last[1])
+			}
+			endpointCertLabels[uptimeResponse.Endpoint] = labels
+			endpointCertInfo.WithLabelValues(uptimeResponse.Endpoint, certificate.Subject, certificate.Issuer).Set(1)
+		}
+
+		// Without a token the endpoint was not checked, so we do not know if it is up
+		if len(uptimeResponse.TokenError) > 0 {
+			endpointTokenOk.WithLabelValues(uptimeResponse.Endpoint).Set(0)
+			continue
+		}
+		if uptimeResponse.TokenUsed {
+			endpointTokenOk.WithLabelValues(uptimeResponse.Endpoint).Set(1)
+		}
+
+		// The endpoint is only down after 'fail-after' failed checks, the
+		// result of the last check itself is in lorona_endpoint_check_ok
+		if endpointStateUp(uptimeResponse) {
 			endpointAvailable.WithLabelValues(uptimeResponse.Endpoint).Set(1)
 		} else {
 			endpointAvailable.WithLabelValues(uptimeResponse.Endpoint).Set(0)
 		}
 
+		endpointCheckOk.WithLabelValues(uptimeResponse.Endpoint).Set(btof(uptimeResponse.Up))
+		endpointFlapping.WithLabelValues(uptimeResponse.Endpoint).Set(btof(uptimeResponse.Flapping))
+		endpointRetries.WithLabelValues(uptimeResponse.Endpoint).Set(float64(uptimeResponse.Retries))
+
+		for _, state := range []string{endpointUnknown, endpointUp, endpointFailing, endpointDown, endpointRecovering} {
+			endpointStateGauge.WithLabelValues(uptimeResponse.Endpoint, state).Set(btof(uptimeResponse.State == state))
+		}
+
 		endpointDuration.WithLabelValues(uptimeResponse.Endpoint).Set(uptimeResponse.ResponseTime.Seconds())
+
+		// Only the parts that were measured, a grpc or dns check has no tls
+		// or transfer time. A part missing in this check is not left from the last
+		phases := uptimeResponse.Timing.phases()
+		for _, phase := range []string{"dns", "connect", "tls", "first_byte", "transfer"} {
+			if duration, ok := phases[phase]; ok {
+				endpointPhaseDuration.WithLabelValues(uptimeResponse.Endpoint, phase).Set(duration.Seconds())
+			} else {
+				endpointPhaseDuration.DeleteLabelValues(uptimeResponse.Endpoint, phase)
+			}
+		}
+
+		for _, step := range uptimeResponse.Steps {
+			endpointStepUp.WithLabelValues(uptimeResponse.Endpoint, step.Name).Set(btof(step.Up))
+			endpointStepDuration.WithLabelValues(uptimeResponse.Endpoint, step.Name).Set(step.ResponseTime.Seconds())
+		}
 	}
 
 	for _, backupInfo := range result.BackupInfoList {
@@ -105,46 +200,103 @@ func UpdateMetrics(result *Results) {
 			backupInfo.LastBackupFile).Set(btof(backupInfo.WasBackedUp))
 	}
 
-	// TODO: This loop is not needed, you can build the summary on the first loop
-	var too_many_lines = 500
-	for _, logLine := range result.LoglineList {
+	// The log monitoring threads count every matched line, even those that
+	// were sampled out or dropped, so we take the counts from there
+	CopyLogSummaries(result)
+
+	// Set the values for the logs. We use two labels (logpath, code)
+	for logFilePath, logSummary := range result.LogSummary {
+
+		for s, value := range logSummary.StatusCount {
+			statusCodes.WithLabelValues(logFilePath, s).Set(float64(value))
+		}
+
+		for s, value := range logSummary.SeverityLevelCount {
+			severity.WithLabelValues(logFilePath, s).Set(float64(value))
+		}
+
+		logLinesMatched.WithLabelValues(logFilePath).Set(float64(logSummary.MatchedLines))
+		logLinesSampled.WithLabelValues(logFilePath).Set(float64(logSummary.SampledLines))
+		logLinesDropped.WithLabelValues(logFilePath).Set(float64(logSummary.DroppedLines))
+		logLinesUnparsed.WithLabelValues(logFilePath).Set(float64(logSummary.UnparsedLines))
+		logParseRatio.WithLabelValues(logFilePath).Set(logSummary.ParseRatio())
+		logStale.WithLabelValues(logFilePath).Set(btof(logSummary.Stale))
+
+		if !logSummary.LastWriteTime.IsZero() {
+			logSecondsSinceWrite.WithLabelValues(logFilePath).Set(time.Since(logSummary.LastWriteTime).Seconds())
+		}
+
+	}
+
+	// The top ips change over time, so we only publish the current ones
+	attackTopIPs.Reset()
+	for logFilePath, logSummary := range result.LogSummary {
 
-		summary, ok := result.LogSummary[logLine.LogPath]
+		for rule, value := range logSummary.AttackRuleHits {
+			attackRuleHits.WithLabelValues(logFilePath, rule).Set(float64(value))
+		}
 
-		if ok == false {
-			summary = LogSummary{}
-			summary.StatusCount = make(map[string]int64)
-			summary.SeverityLevelCount = make(map[string]int64)
+		for _, ipCount := range logSummary.TopAttackIPs {
+			attackTopIPs.WithLabelValues(logFilePath, ipCount.IP).Set(float64(ipCount.Count))
 		}
+	}
 
-		summary.StatusCount[logLine.StatusCode] = summary.StatusCount[logLine.StatusCode] + 1
+	// Auth logs. The top ips change over time too
+	authFailuresByIP.Reset()
+	for logFilePath, logSummary := range result.LogSummary {
 
-		if len(logLine.Severity) > 0 {
-			summary.SeverityLevelCount[logLine.Severity] = summary.SeverityLevelCount[logLine.Severity] + 1
+		if logSummary.AuthEventCount == nil {
+			continue
 		}
 
-		result.LogSummary[logLine.LogPath] = summary
+		for event, value := range logSummary.AuthEventCount {
+			authEvents.WithLabelValues(logFilePath, event).Set(float64(value))
+		}
 
-		if too_many_lines <= 0 {
-			// Pending a better solution, let's not allow the processing
-			// of too many lines, to not kill the server
-			lLog.Print("Too many lines for a single tick to process")
-			break
+		for _, ipCount := range logSummary.TopAuthFailureIPs {
+			authFailuresByIP.WithLabelValues(logFilePath, ipCount.Name).Set(float64(ipCount.Count))
 		}
 
+		authBruteForceSources.WithLabelValues(logFilePath).Set(float64(logSummary.BruteForceSources))
 	}
 
-	// Set the values for the logs. We use two labels (logpath, code)
+	// The slowest queries change over time, so we only publish the current ones
+	slowQueryCount.Reset()
+	slowQueryTimeTotal.Reset()
+	slowQueryTimeMax.Reset()
 	for logFilePath, logSummary := range result.LogSummary {
+		for _, stats := range logSummary.TopSlowQueries {
+			slowQueryCount.WithLabelValues(logFilePath, stats.ID, stats.Fingerprint).Set(float64(stats.Count))
+			slowQueryTimeTotal.WithLabelValues(logFilePath, stats.ID, stats.Fingerprint).Set(stats.TotalTime)
+			slowQueryTimeMax.WithLabelValues(logFilePath, stats.ID, stats.Fingerprint).Set(stats.MaxTime)
+		}
+	}
 
-		for s, value := range logSummary.StatusCount {
-			statusCodes.WithLabelValues(logFilePath, s).Set(float64(value))
+	// Availability of the endpoints over the last 24h, 7d and 30d
+	result.SLAList = CurrentSLAReports()
+	for _, report := range result.SLAList {
+		for _, window := range report.Windows {
+			endpointAvailability.WithLabelValues(report.Endpoint, window.Window).Set(window.Availability)
+			endpointIncidents.WithLabelValues(report.Endpoint, window.Window).Set(float64(window.Incidents))
 		}
+		endpointErrorBudget.WithLabelValues(report.Endpoint).Set(report.ErrorBudgetRemaining)
+	}
 
-		for s, value := range logSummary.SeverityLevelCount {
-			severity.WithLabelValues(logFilePath, s).Set(float64(value))
+	// Clients that are banned right now
+	result.BanList = CurrentBans()
+	bannedClients.Set(float64(len(result.BanList)))
+
+	// Values of the windowed conditions
+	windowValuesMutex.Lock()
+	for logFilePath, values := range windowValues {
+		for condition, value := range values {
+			logWindowValue.WithLabelValues(logFilePath, condition).Set(float64(value))
 		}
+	}
+	windowValuesMutex.Unlock()
 
+	for _, event := range result.EventList {
+		eventFiring.WithLabelValues(event.Source, event.Name).Set(btof(event.Firing))
 	}
 }
 
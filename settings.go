@@ -7,6 +7,8 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -25,8 +27,17 @@ type Settings struct {
 	SysMonitorRequest    SystemMonitorRequest   `yaml:"system"`                // Requests for the system parameters we want to monitor
 	BackupMonitorRequest []BackupMonitorRequest `yaml:"backups-monitor"`       // Requests for the log files we want to monitor
 	ObservedBackupFiles  []string               // This is where we store the backup files we have seen in our backup folders already
+	ClientBanRequest     ClientBanRequest       `yaml:"client-bans"`    // Limits for banning abusive clients seen in the logs
+	UptimeHistoryRequest UptimeHistoryRequest   `yaml:"uptime-history"` // Where the results of the uptime checks are kept, for the availability reports
+	ActiveBans           map[string]time.Time   // The banned ips and when their ban expires. This is persisted in the lorona.dat file
+	KnownLoginIPs        map[string]time.Time   // user@ip for each login seen in auth logs, and when it was last seen. This is persisted in the lorona.dat file
 }
 
+// Some maps in the settings, like the active bans, are changed by several
+// threads and persisted in the data file. This is held while they are
+// changed, and while SaveData writes them.
+var dataMutex = &sync.Mutex{}
+
 // Configuration for logging
 type LogConfig struct {
 	ConsoleLoggingEnabled bool
@@ -70,6 +81,26 @@ func LoadSettings(settingsFile string) (*Settings, error) {
 			settings.UptimeRequestList[i].CheckInterval = "5m" // 5 minutes
 		}
 
+		if len(settings.UptimeRequestList[i].ExpectedStatus) <= 0 {
+			settings.UptimeRequestList[i].ExpectedStatus = "2xx"
+		}
+
+		if len(settings.UptimeRequestList[i].Timeout) <= 0 {
+			settings.UptimeRequestList[i].Timeout = "30s"
+		}
+
+		if settings.UptimeRequestList[i].CertWarningDays <= 0 {
+			settings.UptimeRequestList[i].CertWarningDays = 14
+		}
+
+		if settings.UptimeRequestList[i].CertCriticalDays <= 0 {
+			settings.UptimeRequestList[i].CertCriticalDays = 3
+		}
+
+		if settings.UptimeRequestList[i].SLO <= 0 {
+			settings.UptimeRequestList[i].SLO = 99.9
+		}
+
 		lLog.Print("Request to monitor endpoint: " + settings.UptimeRequestList[i].Endpoint + " @ " + settings.UptimeRequestList[i].CheckInterval + "\n")
 	}
 
@@ -83,6 +114,11 @@ func LoadSettings(settingsFile string) (*Settings, error) {
 			settings.LogFiles[i].AlertInterval = "15m" // 15 minutes
 		}
 
+		// If no sample rate is set, we keep every captured line
+		if settings.LogFiles[i].SampleRate <= 0 || settings.LogFiles[i].SampleRate > 1 {
+			settings.LogFiles[i].SampleRate = 1
+		}
+
 		_, err := os.Stat(settings.LogFiles[i].Filepath)
 		if os.IsNotExist(err) {
 			lLog.Print("WARNING: File " + settings.LogFiles[i].Filepath + " does not exist!")
@@ -91,6 +127,18 @@ func LoadSettings(settingsFile string) (*Settings, error) {
 		lLog.Print("Request to monitor logfile: " + settings.LogFiles[i].Filepath + " @ " + settings.LogFiles[i].AlertInterval + "\n")
 	}
 
+	// Keep the results of the uptime checks for a bit more than a year,
+	// so the reports can compare a month with the one a year before. The
+	// file is next to the data file, not in the directory lorona runs in,
+	// which is / under systemd
+	if len(settings.UptimeHistoryRequest.File) <= 0 {
+		settings.UptimeHistoryRequest.File = path.Join(path.Dir(settings.DataFile), "uptime_history.dat")
+	}
+
+	if settings.UptimeHistoryRequest.RetentionDays <= 0 {
+		settings.UptimeHistoryRequest.RetentionDays = 400
+	}
+
 	SaveData(settings)
 
 	return settings, nil
@@ -129,15 +177,47 @@ func LoadLogFileRegex() (error, map[string]string) {
 			if len(items) == 2 {
 
 				// Save in the key-value, remove leading spaces and quotes
-				regexes[strings.TrimSpace(items[0])] = strings.Trim(strings.TrimSpace(items[1]), "\"'")
+				regexes[strings.TrimSpace(items[0])] = trimQuotes(strings.TrimSpace(items[1]))
 			}
 
 		}
 	}
 
+	// Formats can be written as grok expressions. We compile them into
+	// normal regexes here, so the rest of lorona only sees regexes. Keys in
+	// capital letters are user defined grok patterns, not formats.
+	grokPatterns := make(map[string]string)
+	for name, format := range regexes {
+		if isGrokPatternName(name) {
+			grokPatterns[name] = format
+			delete(regexes, name)
+		}
+	}
+
+	for name, format := range regexes {
+		if isGrokExpression(format) {
+			regex, err := CompileGrok(format, grokPatterns)
+			if err != nil {
+				lLog.Print("Could not compile grok format " + name + ": " + err.Error())
+				delete(regexes, name)
+				continue
+			}
+			regexes[name] = regex
+		}
+	}
+
 	return nil, regexes
 }
 
+// Removes one pair of matching quotes around a value. Only the outer pair
+// is removed, as formats often end in a quote that is part of the regex.
+func trimQuotes(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
 // Loads the last settings file. We need it for some stuff
 // like info about the log files
 func LoadData(settings *Settings) error {
@@ -158,6 +238,10 @@ func LoadData(settings *Settings) error {
 		return err
 	}
 
+	// Bans stay in place over a restart, until they expire
+	settings.ActiveBans = dataSettings.ActiveBans
+	settings.KnownLoginIPs = dataSettings.KnownLoginIPs
+
 	// We transfer all the position info from the log files to the settings
 	// structure. This position info is used to make sure we read from a pos
 	// advanced in the file (efficiency)
@@ -194,13 +278,22 @@ func SaveData(settings *Settings) error {
 		return err
 	}
 
-	// serialize the data
+	// serialize the data. The bans and known logins are only kept in this
+	// file, so we make sure to notice when it could not be written
 	dataEncoder := gob.NewEncoder(dataFile)
-	dataEncoder.Encode(&settings)
+	err = dataEncoder.Encode(&settings)
+	if err != nil {
+		dataFile.Close()
+		lLog.Print("Could not save data: " + err.Error())
+		return err
+	}
 
-	dataFile.Close()
+	err = dataFile.Close()
+	if err != nil {
+		lLog.Print("Could not save data: " + err.Error())
+	}
 
-	return nil
+	return err
 }
 
 type Logger struct {
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The canonical severity levels, from least to most severe. They follow
+// the syslog levels. Every log format has its own names for these, e.g
+// nginx says 'warn' and laravel 'WARNING', so we map them all to these.
+var severityLevels = []string{"debug", "info", "notice", "warning", "error", "critical", "alert", "emergency"}
+
+// The names used by the common log formats, mapped to the canonical level
+var severityAliases = map[string]string{
+	"trace":         "debug",
+	"debug":         "debug",
+	"dbg":           "debug",
+	"info":          "info",
+	"information":   "info",
+	"informational": "info",
+	"notice":        "notice",
+	"warn":          "warning",
+	"warning":       "warning",
+	"err":           "error",
+	"error":         "error",
+	"crit":          "critical",
+	"critical":      "critical",
+	"fatal":         "critical",
+	"severe":        "critical",
+	"alert":         "alert",
+	"emerg":         "emergency",
+	"emergency":     "emergency",
+	"panic":         "emergency",
+}
+
+// Matches comparisons like 'severity >= warning' in conditions
+var severityConditionRegex = regexp.MustCompile(`\bseverity\s*(>=|<=|>|<)\s*["']?(\w+)["']?`)
+
+// Returns the canonical level for the severity of a line. The overrides
+// from the settings of the log are checked first. Numbers are taken as
+// syslog priorities, where 0 is emergency and 7 is debug. Unknown values
+// are returned in lower case.
+func normalizeSeverity(raw string, overrides map[string]string) string {
+
+	raw = strings.TrimSpace(raw)
+
+	if level, ok := overrides[raw]; ok {
+		return strings.ToLower(level)
+	}
+
+	lower := strings.ToLower(raw)
+	if level, ok := overrides[lower]; ok {
+		return strings.ToLower(level)
+	}
+
+	if level, ok := severityAliases[lower]; ok {
+		return level
+	}
+
+	// Syslog priorities can be written as <13>, the level is the last 3 bits
+	if priority, err := strconv.Atoi(strings.Trim(lower, "<>")); err == nil && priority >= 0 {
+		return severityLevels[len(severityLevels)-1-priority%8]
+	}
+
+	return lower
+}
+
+// Returns the rank of a canonical level, higher is more severe. Unknown
+// levels return -1.
+func severityRank(level string) int {
+	for i, l := range severityLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// Rewrites comparisons like 'severity >= warning' to compare the rank of
+// the severity, so they work the same for every log format.
+func rewriteSeverityConditions(conditions []string) []string {
+
+	var rewritten []string
+
+	for _, condition := range conditions {
+		condition = severityConditionRegex.ReplaceAllStringFunc(condition, func(comparison string) string {
+			parts := severityConditionRegex.FindStringSubmatch(comparison)
+			rank := severityRank(normalizeSeverity(parts[2], nil))
+			if rank < 0 {
+				return comparison
+			}
+			return "int_severity " + parts[1] + " " + strconv.Itoa(rank)
+		})
+		rewritten = append(rewritten, condition)
+	}
+
+	return rewritten
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestNormalizeSeverity(t *testing.T) {
+
+	tests := []struct {
+		raw       string
+		overrides map[string]string
+		level     string
+	}{
+		{"WARN", nil, "warning"},
+		{" Error ", nil, "error"},
+		{"fatal", nil, "critical"},
+		{"EMERG", nil, "emergency"},
+		{"3", nil, "error"},
+		{"<13>", nil, "notice"},
+		{"EXCEPTION", map[string]string{"EXCEPTION": "Error"}, "error"},
+		{"exception", map[string]string{"exception": "critical"}, "critical"},
+		{"warn", map[string]string{"warn": "notice"}, "notice"},
+		{"Custom", nil, "custom"},
+	}
+
+	for _, test := range tests {
+		if level := normalizeSeverity(test.raw, test.overrides); level != test.level {
+			t.Errorf("severity %q is %q, expected %q", test.raw, level, test.level)
+		}
+	}
+}
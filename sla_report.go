@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The availability of one endpoint in the month of the report
+type SLAReportLine struct {
+	Endpoint     string
+	SLO          float64
+	Availability float64 // In percent
+	Checks       int64
+	Downtime     time.Duration
+	Incidents    []SLAIncident
+	Met          bool
+}
+
+var slaReportTemplate = template.Must(template.New("sla").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Availability {{.Month}} - {{.Container}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+.met { color: #080; }
+.missed { color: #c00; }
+</style>
+</head>
+<body>
+<h1>Availability {{.Month}}</h1>
+<p>{{.Container}}{{if .Description}} - {{.Description}}{{end}}</p>
+<table>
+<tr><th>Endpoint</th><th>Availability</th><th>SLO</th><th>Checks</th><th>Incidents</th><th>Downtime</th><th></th></tr>
+{{range .Lines}}<tr><td>{{.Endpoint}}</td><td>{{printf "%.3f" .Availability}}%</td><td>{{.SLO}}%</td><td>{{.Checks}}</td><td>{{len .Incidents}}</td><td>{{.Downtime}}</td><td>{{if .Met}}<span class="met">Met</span>{{else}}<span class="missed">Missed</span>{{end}}</td></tr>
+{{end}}</table>
+{{range .Lines}}{{if .Incidents}}<h2>{{.Endpoint}}</h2>
+<table>
+<tr><th>Down since</th><th>Up again</th><th>Downtime</th></tr>
+{{range .Incidents}}<tr><td>{{.Start.Format "2006-01-02 15:04:05"}}</td><td>{{if .End.IsZero}}-{{else}}{{.End.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.Duration}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// Writes the availability of the endpoints in a month from the uptime
+// history, e.g 'lorona sla-report --month 2024-05 --format html'. Without
+// a month it reports on the one before this one. Returns an error if no
+// complete report was written.
+func RunSLAReportCommand(settings *Settings, args []string) error {
+
+	lastMonth := time.Now().AddDate(0, -1, 0).Format("2006-01")
+
+	flags := flag.NewFlagSet("sla-report", flag.ExitOnError)
+	month := flags.String("month", lastMonth, "The month to report on, as YYYY-MM")
+	format := flags.String("format", "csv", "csv or html")
+	output := flags.String("output", "", "The file to write the report to, stdout if not set")
+	flags.Parse(args)
+
+	start, err := time.ParseInLocation("2006-01", *month, time.Local)
+	if err != nil {
+		return errors.New("Invalid month " + *month + ", expected YYYY-MM")
+	}
+	end := start.AddDate(0, 1, 0)
+
+	// With the results just before and after the month, the time before its
+	// first check and incidents that go on into the next month are known
+	records, err := readUptimeHistoryAround(settings.UptimeHistoryRequest.File, start, end)
+	if err != nil {
+		return errors.New("Could not read uptime history: " + err.Error())
+	}
+
+	lines := slaReportLines(settings, records, start, end)
+
+	writer := io.Writer(os.Stdout)
+	if len(*output) > 0 {
+		file, err := os.Create(*output)
+		if err != nil {
+			return errors.New("Could not write report: " + err.Error())
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	switch *format {
+	case "csv":
+		err = writeSLAReportCSV(writer, lines)
+	case "html":
+		err = slaReportTemplate.Execute(writer, map[string]interface{}{
+			"Month":       *month,
+			"Container":   settings.ContainerName,
+			"Description": settings.ContainerDescription,
+			"Lines":       lines,
+		})
+	default:
+		return errors.New("Unknown format " + *format + ", expected csv or html")
+	}
+
+	if err != nil {
+		return errors.New("Could not write report: " + err.Error())
+	}
+
+	return nil
+}
+
+// Works out the availability of each endpoint in the history. Endpoints that
+// are no longer in the settings are reported with the default SLO.
+func slaReportLines(settings *Settings, records map[string][]uptimeRecord, start time.Time, end time.Time) []SLAReportLine {
+
+	slos := make(map[string]float64)
+	for _, uptimeRequest := range settings.UptimeRequestList {
+		slos[uptimeRequest.Endpoint] = uptimeRequest.SLO
+	}
+
+	lines := []SLAReportLine{}
+	for endpoint, endpointRecords := range records {
+
+		// Only checked after the month
+		if !endpointRecords[0].Time.Before(end) {
+			continue
+		}
+
+		window, incidents := computeSLAWindow(endpointRecords, start, end)
+
+		line := SLAReportLine{}
+		line.Endpoint = endpoint
+		line.SLO = slos[endpoint]
+		if line.SLO <= 0 {
+			line.SLO = 99.9
+		}
+		line.Availability = window.Availability * 100
+		line.Checks = window.Checks
+		line.Downtime = window.Downtime
+		line.Incidents = incidents
+		line.Met = line.Availability >= line.SLO
+
+		lines = append(lines, line)
+	}
+
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Endpoint < lines[j].Endpoint })
+
+	return lines
+}
+
+func writeSLAReportCSV(writer io.Writer, lines []SLAReportLine) error {
+
+	csvWriter := csv.NewWriter(writer)
+	csvWriter.Write([]string{"endpoint", "availability", "slo", "checks", "incidents", "downtime_seconds", "met"})
+
+	for _, line := range lines {
+		csvWriter.Write([]string{
+			line.Endpoint,
+			strconv.FormatFloat(line.Availability, 'f', 3, 64),
+			strconv.FormatFloat(line.SLO, 'f', -1, 64),
+			itoa(line.Checks),
+			strconv.Itoa(len(line.Incidents)),
+			itoa(int64(line.Downtime.Seconds())),
+			btoa(line.Met),
+		})
+	}
+
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
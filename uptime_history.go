@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The settings for keeping the results of the uptime checks, in the
+// 'uptime-history' section
+type UptimeHistoryRequest struct {
+	File          string `yaml:"file"`           // uptime_history.dat in the directory of the data file if not set
+	RetentionDays int    `yaml:"retention-days"` // Older results are removed when lorona starts and once a day, 400 if not set
+}
+
+// The result of one check, as kept in the history
+type uptimeRecord struct {
+	Time         time.Time
+	Up           bool
+	ResponseTime time.Duration
+}
+
+// The availability of an endpoint over one window, e.g the last 7 days. It
+// is based on time, not on the number of checks: each result counts from its
+// check until the next one, and the availability is the share of that time
+// the endpoint was up. So it always matches the downtime, also when the
+// interval of the checks changed.
+type SLAWindow struct {
+	Window       string
+	Availability float64 // Between 0 and 1
+	Checks       int64
+	Incidents    int64         // The times it went down
+	Downtime     time.Duration // The time within the window the endpoint was down
+}
+
+// The availability of an endpoint over the 24h, 7d and 30d windows
+type SLAReport struct {
+	Endpoint             string
+	SLO                  float64 // The target availability, in percent
+	Windows              []SLAWindow
+	ErrorBudgetRemaining float64 // The share of the allowed downtime of the 30d window that is left. Negative if the SLO was missed
+}
+
+// A time an endpoint was down. Start and End are when it went down and up
+// again, also if that was outside the window, and the Duration is the part
+// within the window.
+type SLAIncident struct {
+	Start    time.Time
+	End      time.Time // Zero if it is still down
+	Duration time.Duration
+}
+
+// The windows we report on
+var slaWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// We keep the results of the largest window in memory, the rest is only
+// in the history file, for the monthly reports
+const uptimeHistoryInMemory = 30 * 24 * time.Hour
+
+var uptimeHistoryMutex = &sync.Mutex{}
+var uptimeHistoryFile string
+var uptimeHistoryRetentionDays int
+var uptimeHistory = make(map[string][]uptimeRecord)
+var uptimeSLOs = make(map[string]float64)
+var slaReports = make(map[string]SLAReport)
+
+// Loads the history file, and removes the results that are older than the
+// retention from it. While lorona runs, they are removed once a day.
+func StartUptimeHistory(settings *Settings) {
+
+	uptimeHistoryMutex.Lock()
+	defer uptimeHistoryMutex.Unlock()
+
+	uptimeHistoryFile = settings.UptimeHistoryRequest.File
+	uptimeHistoryRetentionDays = settings.UptimeHistoryRequest.RetentionDays
+
+	for _, uptimeRequest := range settings.UptimeRequestList {
+		uptimeSLOs[uptimeRequest.Endpoint] = uptimeRequest.SLO
+	}
+
+	memoryStart := time.Now().Add(-uptimeHistoryInMemory)
+
+	records, err := pruneUptimeHistory(time.Now())
+	if err != nil && !os.IsNotExist(err) {
+		lLog.Print("Could not read uptime history: " + err.Error())
+	}
+
+	for endpoint, endpointRecords := range records {
+		endpointRecords = trimUptimeRecords(endpointRecords, memoryStart)
+		if len(endpointRecords) == 0 || endpointRecords[len(endpointRecords)-1].Time.Before(memoryStart) {
+			continue
+		}
+		uptimeHistory[endpoint] = endpointRecords
+		updateSLAReport(endpoint)
+	}
+
+	go watchUptimeHistoryRetention()
+}
+
+// Removes the results that are older than the retention from the history
+// file, and returns the ones that are left. Must be called with the mutex
+// held.
+func pruneUptimeHistory(now time.Time) (map[string][]uptimeRecord, error) {
+
+	retentionStart := now.AddDate(0, 0, -uptimeHistoryRetentionDays)
+
+	records, dropped, err := readUptimeHistory(uptimeHistoryFile, retentionStart, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if dropped > 0 {
+		writeUptimeHistory(uptimeHistoryFile, records)
+	}
+
+	return records, nil
+}
+
+// Removes old results from the history file once a day, so it does not
+// grow while lorona runs for a long time
+func watchUptimeHistoryRetention() {
+
+	for {
+		time.Sleep(24 * time.Hour)
+
+		if stopEndpointMonitoring == true {
+			return
+		}
+
+		uptimeHistoryMutex.Lock()
+		if _, err := pruneUptimeHistory(time.Now()); err != nil && !os.IsNotExist(err) {
+			lLog.Print("Could not read uptime history: " + err.Error())
+		}
+		uptimeHistoryMutex.Unlock()
+	}
+}
+
+// Adds the result of a check to the history. Checks without a token did
+// not tell us if the endpoint is up, so they are left out.
+func RecordUptime(uptime UptimeResponse) {
+
+	if len(uptime.TokenError) > 0 || len(uptimeHistoryFile) == 0 {
+		return
+	}
+
+	record := uptimeRecord{Time: time.Now(), Up: endpointStateUp(uptime), ResponseTime: uptime.ResponseTime}
+
+	uptimeHistoryMutex.Lock()
+	defer uptimeHistoryMutex.Unlock()
+
+	file, err := os.OpenFile(uptimeHistoryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		lLog.Print("Could not write uptime history: " + err.Error())
+	} else {
+		file.WriteString(formatUptimeRecord(uptime.Endpoint, record))
+		file.Close()
+	}
+
+	records := append(uptimeHistory[uptime.Endpoint], record)
+	uptimeHistory[uptime.Endpoint] = trimUptimeRecords(records, time.Now().Add(-uptimeHistoryInMemory))
+
+	updateSLAReport(uptime.Endpoint)
+}
+
+// Drops the results before the start, except the last one. It tells if the
+// endpoint was up at the start, until the next result.
+func trimUptimeRecords(records []uptimeRecord, start time.Time) []uptimeRecord {
+
+	first := 0
+	for first+1 < len(records) && records[first+1].Time.Before(start) {
+		first++
+	}
+
+	return records[first:]
+}
+
+// Returns the current reports, for the results
+func CurrentSLAReports() []SLAReport {
+
+	uptimeHistoryMutex.Lock()
+	defer uptimeHistoryMutex.Unlock()
+
+	reports := []SLAReport{}
+	for _, report := range slaReports {
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+// Works out the availability of an endpoint over each window. Must be
+// called with the mutex held.
+func updateSLAReport(endpoint string) {
+
+	now := time.Now()
+	records := uptimeHistory[endpoint]
+
+	report := SLAReport{}
+	report.Endpoint = endpoint
+	report.SLO = uptimeSLOs[endpoint]
+	if report.SLO <= 0 {
+		report.SLO = 99.9
+	}
+
+	for _, window := range slaWindows {
+		slaWindow, _ := computeSLAWindow(records, now.Add(-window.duration), now)
+		slaWindow.Window = window.name
+		report.Windows = append(report.Windows, slaWindow)
+	}
+
+	report.ErrorBudgetRemaining = errorBudgetRemaining(report.Windows[len(report.Windows)-1].Availability, report.SLO)
+
+	slaReports[endpoint] = report
+}
+
+// Works out the availability and incidents from the start of a time span
+// until just before its end. The results must be in time order, and can
+// include the one before the start and the one after the end, so we know
+// the state at the start and when an incident at the end is over. Each
+// result counts for the time until the next one, the time before the first
+// result is not counted.
+func computeSLAWindow(records []uptimeRecord, start time.Time, end time.Time) (SLAWindow, []SLAIncident) {
+
+	var window SLAWindow
+	var incidents []SLAIncident
+	var observed time.Duration
+	var downSince time.Time
+
+	// The time after now has not happened yet
+	observedEnd := end
+	if now := time.Now(); now.Before(observedEnd) {
+		observedEnd = now
+	}
+
+	for i, record := range records {
+
+		// Follow when the endpoint went down and up again, also outside the
+		// window, so we know the whole incident
+		if !record.Up && downSince.IsZero() {
+			downSince = record.Time
+		} else if record.Up && !downSince.IsZero() {
+			if len(incidents) > 0 && incidents[len(incidents)-1].Start.Equal(downSince) {
+				incidents[len(incidents)-1].End = record.Time
+			}
+			downSince = time.Time{}
+		}
+
+		if !record.Time.Before(start) && record.Time.Before(end) {
+			window.Checks++
+		}
+
+		// The part of the window this result counts for
+		spanStart, spanEnd := record.Time, observedEnd
+		if i+1 < len(records) && records[i+1].Time.Before(observedEnd) {
+			spanEnd = records[i+1].Time
+		}
+		if spanStart.Before(start) {
+			spanStart = start
+		}
+		if !spanEnd.After(spanStart) {
+			continue
+		}
+
+		span := spanEnd.Sub(spanStart)
+		observed += span
+
+		if record.Up {
+			continue
+		}
+
+		window.Downtime += span
+
+		if len(incidents) == 0 || !incidents[len(incidents)-1].Start.Equal(downSince) {
+			incidents = append(incidents, SLAIncident{Start: downSince})
+		}
+		incidents[len(incidents)-1].Duration += span
+	}
+
+	window.Incidents = int64(len(incidents))
+	window.Availability = 1
+	if observed > 0 {
+		window.Availability = 1 - float64(window.Downtime)/float64(observed)
+	}
+
+	return window, incidents
+}
+
+// The share of the allowed downtime that is left, e.g with an SLO of 99.9%
+// and an availability of 99.95%, half of the budget is left
+func errorBudgetRemaining(availability float64, slo float64) float64 {
+
+	allowed := 1 - slo/100
+	if allowed <= 0 {
+		if availability >= 1 {
+			return 1
+		}
+		return 0
+	}
+
+	return 1 - (1-availability)/allowed
+}
+
+// The history has one line per check: the unix time, 1 or 0 for up, the
+// response time in milliseconds and the endpoint
+func formatUptimeRecord(endpoint string, record uptimeRecord) string {
+	return strconv.FormatInt(record.Time.Unix(), 10) + " " + btoa(record.Up) + " " +
+		strconv.FormatInt(record.ResponseTime.Milliseconds(), 10) + " " + endpoint + "\n"
+}
+
+// Reads a line of the history file
+func parseUptimeRecord(line string) (string, uptimeRecord, bool) {
+
+	var record uptimeRecord
+
+	parts := strings.SplitN(line, " ", 4)
+	if len(parts) != 4 {
+		return "", record, false
+	}
+
+	seconds, err1 := strconv.ParseInt(parts[0], 10, 64)
+	milliseconds, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return "", record, false
+	}
+
+	record.Time = time.Unix(seconds, 0)
+	record.Up = parts[1] == "1"
+	record.ResponseTime = time.Duration(milliseconds) * time.Millisecond
+
+	return parts[3], record, true
+}
+
+// Reads the results within a time span from the history file, per endpoint.
+// Also returns how many results were outside the span.
+func readUptimeHistory(historyFile string, start time.Time, end time.Time) (map[string][]uptimeRecord, int, error) {
+
+	file, err := os.Open(historyFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	records := make(map[string][]uptimeRecord)
+	dropped := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		endpoint, record, ok := parseUptimeRecord(scanner.Text())
+		if !ok || record.Time.Before(start) || record.Time.After(end) {
+			dropped++
+			continue
+		}
+
+		records[endpoint] = append(records[endpoint], record)
+	}
+
+	return records, dropped, scanner.Err()
+}
+
+// Reads the results within a time span from the history file, per endpoint,
+// with the last result before the span and the first one after it
+func readUptimeHistoryAround(historyFile string, start time.Time, end time.Time) (map[string][]uptimeRecord, error) {
+
+	file, err := os.Open(historyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	before := make(map[string]uptimeRecord)
+	after := make(map[string]uptimeRecord)
+	within := make(map[string][]uptimeRecord)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		endpoint, record, ok := parseUptimeRecord(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		if record.Time.Before(start) {
+			if last, found := before[endpoint]; !found || record.Time.After(last.Time) {
+				before[endpoint] = record
+			}
+		} else if !record.Time.Before(end) {
+			if first, found := after[endpoint]; !found || record.Time.Before(first.Time) {
+				after[endpoint] = record
+			}
+		} else {
+			within[endpoint] = append(within[endpoint], record)
+		}
+	}
+
+	records := make(map[string][]uptimeRecord)
+	for endpoint, record := range before {
+		records[endpoint] = append(records[endpoint], record)
+	}
+	for endpoint, endpointRecords := range within {
+		records[endpoint] = append(records[endpoint], endpointRecords...)
+	}
+	for endpoint, record := range after {
+		records[endpoint] = append(records[endpoint], record)
+	}
+
+	return records, scanner.Err()
+}
+
+// Writes the history file again, e.g without the old results. We write to
+// a temporary file first, so a crash does not lose the history.
+func writeUptimeHistory(historyFile string, records map[string][]uptimeRecord) {
+
+	tempFile := historyFile + ".tmp"
+
+	file, err := os.Create(tempFile)
+	if err != nil {
+		lLog.Print("Could not write uptime history: " + err.Error())
+		return
+	}
+
+	writer := bufio.NewWriter(file)
+	for endpoint, endpointRecords := range records {
+		for _, record := range endpointRecords {
+			writer.WriteString(formatUptimeRecord(endpoint, record))
+		}
+	}
+	writer.Flush()
+	file.Close()
+
+	if err := os.Rename(tempFile, historyFile); err != nil {
+		lLog.Print("Could not write uptime history: " + err.Error())
+	}
+}
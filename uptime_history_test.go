@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeSLAWindow(t *testing.T) {
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(10 * time.Hour)
+
+	at := func(hours int, up bool) uptimeRecord {
+		return uptimeRecord{Time: start.Add(time.Duration(hours) * time.Hour), Up: up}
+	}
+	hour := func(hours int) time.Time {
+		return start.Add(time.Duration(hours) * time.Hour)
+	}
+
+	tests := []struct {
+		name         string
+		records      []uptimeRecord
+		availability float64
+		checks       int64
+		downtime     time.Duration
+		incidents    []SLAIncident
+	}{
+		{
+			name:         "no results",
+			availability: 1,
+		},
+		{
+			name:         "always up",
+			records:      []uptimeRecord{at(0, true), at(5, true)},
+			availability: 1,
+			checks:       2,
+		},
+		{
+			name:         "down in the middle",
+			records:      []uptimeRecord{at(0, true), at(2, false), at(3, true)},
+			availability: 0.9,
+			checks:       3,
+			downtime:     time.Hour,
+			incidents:    []SLAIncident{{Start: hour(2), End: hour(3), Duration: time.Hour}},
+		},
+		{
+			name:         "down before the window",
+			records:      []uptimeRecord{at(-1, false), at(2, true)},
+			availability: 0.8,
+			checks:       1,
+			downtime:     2 * time.Hour,
+			incidents:    []SLAIncident{{Start: hour(-1), End: hour(2), Duration: 2 * time.Hour}},
+		},
+		{
+			name:         "up again after the window",
+			records:      []uptimeRecord{at(0, true), at(9, false), at(12, true)},
+			availability: 0.9,
+			checks:       2,
+			downtime:     time.Hour,
+			incidents:    []SLAIncident{{Start: hour(9), End: hour(12), Duration: time.Hour}},
+		},
+		{
+			name:         "still down",
+			records:      []uptimeRecord{at(0, true), at(8, false)},
+			availability: 0.8,
+			checks:       2,
+			downtime:     2 * time.Hour,
+			incidents:    []SLAIncident{{Start: hour(8), Duration: 2 * time.Hour}},
+		},
+		{
+			name:         "time before the first result is not counted",
+			records:      []uptimeRecord{at(5, true), at(9, false)},
+			availability: 0.8,
+			checks:       2,
+			downtime:     time.Hour,
+			incidents:    []SLAIncident{{Start: hour(9), Duration: time.Hour}},
+		},
+		{
+			name:         "failed checks in a row are one incident",
+			records:      []uptimeRecord{at(0, false), at(1, false), at(2, false), at(5, true), at(6, false), at(7, true)},
+			availability: 0.4,
+			checks:       6,
+			downtime:     6 * time.Hour,
+			incidents: []SLAIncident{
+				{Start: hour(0), End: hour(5), Duration: 5 * time.Hour},
+				{Start: hour(6), End: hour(7), Duration: time.Hour},
+			},
+		},
+	}
+
+	for _, test := range tests {
+
+		window, incidents := computeSLAWindow(test.records, start, end)
+
+		if diff := window.Availability - test.availability; diff > 1e-9 || diff < -1e-9 {
+			t.Errorf("%s: availability is %v, expected %v", test.name, window.Availability, test.availability)
+		}
+		if window.Checks != test.checks {
+			t.Errorf("%s: checks are %d, expected %d", test.name, window.Checks, test.checks)
+		}
+		if window.Downtime != test.downtime {
+			t.Errorf("%s: downtime is %v, expected %v", test.name, window.Downtime, test.downtime)
+		}
+		if window.Incidents != int64(len(test.incidents)) || len(incidents) != len(test.incidents) {
+			t.Errorf("%s: %d incidents, expected %d", test.name, len(incidents), len(test.incidents))
+			continue
+		}
+		for i, incident := range incidents {
+			expected := test.incidents[i]
+			if !incident.Start.Equal(expected.Start) || !incident.End.Equal(expected.End) || incident.Duration != expected.Duration {
+				t.Errorf("%s: incident %d is %v - %v (%v), expected %v - %v (%v)", test.name, i,
+					incident.Start, incident.End, incident.Duration, expected.Start, expected.End, expected.Duration)
+			}
+		}
+	}
+}
+
+func TestPruneUptimeHistory(t *testing.T) {
+
+	now := time.Now().Truncate(time.Second)
+	historyFile := filepath.Join(t.TempDir(), "uptime_history.dat")
+
+	content := formatUptimeRecord("https://a.example", uptimeRecord{Time: now.AddDate(0, 0, -500), Up: true}) +
+		formatUptimeRecord("https://a.example", uptimeRecord{Time: now.AddDate(0, 0, -10), Up: false}) +
+		"not a result\n" +
+		formatUptimeRecord("https://b.example", uptimeRecord{Time: now.AddDate(0, 0, -401), Up: true}) +
+		formatUptimeRecord("https://b.example", uptimeRecord{Time: now.Add(-time.Hour), Up: true, ResponseTime: 120 * time.Millisecond})
+
+	if err := os.WriteFile(historyFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uptimeHistoryFile, uptimeHistoryRetentionDays = historyFile, 400
+	defer func() { uptimeHistoryFile, uptimeHistoryRetentionDays = "", 0 }()
+
+	records, err := pruneUptimeHistory(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records["https://a.example"]) != 1 || len(records["https://b.example"]) != 1 {
+		t.Errorf("kept %v, expected one result per endpoint", records)
+	}
+
+	// The file only has the results within the retention left
+	written, _ := os.ReadFile(historyFile)
+	lines := strings.Split(strings.TrimSpace(string(written)), "\n")
+	if len(lines) != 2 {
+		t.Errorf("the history file has %d lines, expected 2:\n%s", len(lines), written)
+	}
+
+	// Nothing to remove the second time
+	if _, err := pruneUptimeHistory(now); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := os.ReadFile(historyFile); string(again) != string(written) {
+		t.Errorf("the history file changed without old results")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// A rule that recognizes a web attack in a parsed access log line
+type AttackRule struct {
+	ID          string   `yaml:"id"`
+	Description string   `yaml:"description"`
+	Fields      []string `yaml:"fields"`  // The fields the pattern is checked against
+	Pattern     string   `yaml:"pattern"` // A regex, matched without regard to case
+	Disabled    bool     `yaml:"disabled"`
+	regex       *regexp.Regexp
+}
+
+// How many IPs we list as top offenders per log
+const topAttackIPCount = 10
+
+// We stop tracking new IPs per log after this many, so a wide scan
+// cannot make us run out of memory
+const maxTrackedAttackIPs = 10000
+
+// The fields of an access log that hold the request
+var requestFields = []string{"description", "request", "path", "url"}
+
+// All ips that sent attack lines per log, with their count
+var attackIPs = make(map[string]map[string]int64)
+var attackIPsMutex = &sync.Mutex{}
+
+// The built-in rules. They can be updated or extended without a new build
+// by putting rules with the same or new ids in attack_rules.yaml
+var defaultAttackRules = []AttackRule{
+	{ID: "sqli-union", Description: "SQL injection using UNION SELECT", Fields: requestFields, Pattern: `union(\s|\+|%20|/\*.*\*/)+(all(\s|\+|%20)+)?select`},
+	{ID: "sqli-tautology", Description: "SQL injection using an always true condition", Fields: requestFields, Pattern: `('|%27)(\s|\+|%20)*(or|and)(\s|\+|%20)+('|%27)?\d+('|%27)?(\s|\+|%20)*(=|%3d)`},
+	{ID: "sqli-functions", Description: "SQL injection using database functions", Fields: requestFields, Pattern: `((sleep|benchmark|load_file|pg_sleep)(\s|\+|%20)*(\(|%28)|information_schema|waitfor(\s|\+|%20)+delay)`},
+	{ID: "path-traversal", Description: "Path traversal to reach files outside the web root", Fields: requestFields, Pattern: `(\.\.|%2e%2e|%252e%252e)(/|\\|%2f|%5c)`},
+	{ID: "sensitive-files", Description: "Request for files with secrets", Fields: requestFields, Pattern: `/(\.env|\.git/|\.svn/|\.htpasswd|\.aws/|wp-config\.php|config\.php\.bak|id_rsa|\.ds_store)`},
+	{ID: "wordpress-probe", Description: "Probing for WordPress logins and admin pages", Fields: requestFields, Pattern: `/(wp-login\.php|xmlrpc\.php|wp-admin/)`},
+	{ID: "php-shell", Description: "Probing for known web shells and admin tools", Fields: requestFields, Pattern: `/(wso|c99|r57|b374k|shell|cmd)\d*\.php|/(phpmyadmin|pma|myadmin)/`},
+	{ID: "xss-script", Description: "Cross site scripting using script tags or handlers", Fields: requestFields, Pattern: `(<|%3c)script|javascript:|on(error|load)(=|%3d)`},
+	{ID: "command-injection", Description: "Shell commands in the request", Fields: requestFields, Pattern: `(;|%3b|\||%7c|\$\(|%24%28)(\s|\+|%20)*(cat|wget|curl|bash|sh|nc)(\s|\+|%20)`},
+	{ID: "scanner-user-agent", Description: "Known vulnerability scanner user agent", Fields: []string{"useragent", "agent"}, Pattern: `(sqlmap|nikto|nmap|masscan|zgrab|nuclei|wpscan|dirbuster|gobuster|acunetix|nessus|openvas|w3af|havij)`},
+}
+
+// The rules in use, after the ones from attack_rules.yaml were merged in
+var attackRules []AttackRule
+
+// Loads the rules. The file is optional, its rules replace the built-in
+// ones with the same id and the others are added.
+func LoadAttackRules(rulesFile string) []AttackRule {
+
+	rules := append([]AttackRule{}, defaultAttackRules...)
+
+	file, err := os.Open(rulesFile)
+	if err == nil {
+		defer file.Close()
+
+		var fileRules []AttackRule
+		if err := yaml.NewDecoder(file).Decode(&fileRules); err != nil {
+			lLog.Print("Could not load attack rules from " + rulesFile + ": " + err.Error())
+		}
+
+		for _, fileRule := range fileRules {
+			replaced := false
+			for i := range rules {
+				if rules[i].ID == fileRule.ID {
+					rules[i] = fileRule
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				rules = append(rules, fileRule)
+			}
+		}
+	}
+
+	var active []AttackRule
+	for _, rule := range rules {
+
+		if rule.Disabled {
+			continue
+		}
+
+		regex, err := regexp.Compile("(?i)" + rule.Pattern)
+		if err != nil {
+			lLog.Print("Could not compile attack rule " + rule.ID + ": " + err.Error())
+			continue
+		}
+
+		if len(rule.Fields) == 0 {
+			rule.Fields = requestFields
+		}
+
+		rule.regex = regex
+		active = append(active, rule)
+	}
+
+	return active
+}
+
+// Checks the fields of a line against all attack rules, and returns the
+// ids of the rules that matched.
+func matchAttackRules(values map[string]interface{}) []string {
+
+	var matched []string
+
+	for _, rule := range attackRules {
+		for _, field := range rule.Fields {
+			value, ok := values[field]
+			if ok && rule.regex.MatchString(vtoa(value)) {
+				matched = append(matched, rule.ID)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// Returns the ip of the client that made the request, if the format has it
+func requestIP(values map[string]interface{}) string {
+	for _, field := range []string{"ipaddress", "clientip", "ip", "remote_addr"} {
+		if value, ok := values[field]; ok {
+			return vtoa(value)
+		}
+	}
+	return ""
+}
+
+// Counts the rules that matched a line, and the ip that sent it
+func countAttack(logPath string, ruleIDs []string, ip string) {
+	logSummariesMutex.Lock()
+	summary := getLogSummary(logPath)
+	if summary.AttackRuleHits == nil {
+		summary.AttackRuleHits = make(map[string]int64)
+	}
+	for _, id := range ruleIDs {
+		summary.AttackRuleHits[id]++
+	}
+	logSummariesMutex.Unlock()
+
+	if len(ip) == 0 {
+		return
+	}
+
+	attackIPsMutex.Lock()
+	defer attackIPsMutex.Unlock()
+
+	ips, ok := attackIPs[logPath]
+	if !ok {
+		ips = make(map[string]int64)
+		attackIPs[logPath] = ips
+	}
+
+	if _, ok := ips[ip]; ok || len(ips) < maxTrackedAttackIPs {
+		ips[ip]++
+	}
+}
+
+// Puts the ips that sent the most attack lines into the summaries. Sorting
+// them is too slow to do for every line, so this runs once per tick.
+func updateTopAttackIPs() {
+
+	attackIPsMutex.Lock()
+	top := make(map[string][]IPCount)
+	for logPath, ips := range attackIPs {
+		top[logPath] = topAttackIPs(ips)
+	}
+	attackIPsMutex.Unlock()
+
+	logSummariesMutex.Lock()
+	defer logSummariesMutex.Unlock()
+
+	for logPath, counts := range top {
+		getLogSummary(logPath).TopAttackIPs = counts
+	}
+}
+
+// An ip and the number of attack lines it sent
+type IPCount struct {
+	IP    string
+	Count int64
+}
+
+// Returns the ips that sent the most attack lines, most first
+func topAttackIPs(attackIPs map[string]int64) []IPCount {
+
+	var counts []IPCount
+	for ip, count := range attackIPs {
+		counts = append(counts, IPCount{ip, count})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].IP < counts[j].IP
+	})
+
+	if len(counts) > topAttackIPCount {
+		counts = counts[:topAttackIPCount]
+	}
+
+	return counts
+}
+
+// Returns the rule ids as a single value for the conditions
+func joinRuleIDs(ruleIDs []string) string {
+	return strings.Join(ruleIDs, ",")
+}